@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/zfjagann/gamma/interp"
+	"github.com/zfjagann/gamma/lineedit"
+	"github.com/zfjagann/gamma/parse"
+	"github.com/zfjagann/gamma/sexpr"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	prompt             = "scheme00> "
+	continuationPrompt = "      ..> "
+	historyFile        = ".gamma_history"
+)
+
+// parenDepth returns the number of parentheses in `text` which have not been closed
+func parenDepth(text string) int {
+	return strings.Count(text, "(") - strings.Count(text, ")")
+}
+
+/*
+console runs the REPL on a terminal, with line editing and the history saved in ~/.gamma_history.
+Lines are read until the parentheses are balanced, and the expressions in them are evaluated in order.
+
+Ctrl-C discards the lines which have been typed, or interrupts the evaluation.
+*/
+func console(env *sexpr.Environ, opts []interp.Option) int {
+	editor := lineedit.NewEditor(os.Stdin, os.Stdout)
+	if home, err := os.UserHomeDir(); err == nil {
+		if err := editor.LoadHistory(filepath.Join(home, historyFile)); err != nil {
+			fmt.Println(err)
+		}
+	}
+	eval := interp.NewInterpreter(env, opts...)
+	editor.Complete = completer(eval)
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	pending := ""
+	for {
+		p := prompt
+		if pending != "" {
+			p = continuationPrompt
+		}
+		line, err := editor.ReadLine(p)
+		if err == lineedit.ErrInterrupt {
+			pending = ""
+			continue
+		} else if err == io.EOF {
+			return 0
+		} else if err != nil {
+			fmt.Println(err)
+			return 255
+		}
+		pending += line + "\n"
+		if parenDepth(pending) > 0 {
+			continue
+		}
+		text := pending
+		pending = ""
+		if err := editor.AddHistory(text); err != nil {
+			fmt.Println(err)
+		}
+
+		parser := parse.NewParser(strings.NewReader(text))
+		for {
+			expr, err := parser.Parse()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				fmt.Println(err)
+				break
+			}
+			output, err := evaluateInterruptibly(eval, expr, interrupts)
+			if err != nil {
+				var exit *interp.ExitError
+				if errors.As(err, &exit) {
+					return exit.Code
+				}
+				if errors.Is(err, interp.Quit) {
+					return 1
+				}
+				if errors.Is(err, context.Canceled) {
+					fmt.Println("interrupted")
+				} else {
+					printError(err)
+				}
+				break
+			} else if output != sexpr.Null {
+				fmt.Printf("%v\n", output)
+			}
+		}
+	}
+}
+
+/*
+completer completes the names bound in the global environment of `eval`, including those defined in the REPL,
+and the special forms. Within a string literal, it completes file paths.
+*/
+func completer(eval *interp.Interpreter) lineedit.Completer {
+	return func(head string) (int, []string) {
+		if strings.Count(head, "\"")%2 == 1 {
+			start := strings.LastIndex(head, "\"") + 1
+			return start, completePath(head[start:])
+		}
+		start := strings.LastIndexAny(head, " \t()'") + 1
+		word := head[start:]
+		candidates := []string{}
+		seen := map[string]bool{}
+		for _, name := range append(eval.Names(), interp.SpecialForms...) {
+			if strings.HasPrefix(name, word) && !seen[name] {
+				seen[name] = true
+				candidates = append(candidates, name)
+			}
+		}
+		sort.Strings(candidates)
+		return start, candidates
+	}
+}
+
+// completePath returns the files whose path starts with `prefix`. Directories end with a "/",
+// and other files with the closing quote of the string.
+func completePath(prefix string) []string {
+	dir, base := filepath.Split(prefix)
+	list := dir
+	if list == "" {
+		list = "."
+	}
+	files, err := ioutil.ReadDir(list)
+	if err != nil {
+		return nil
+	}
+	candidates := []string{}
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, base) || (strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".")) {
+			continue
+		}
+		if f.IsDir() {
+			name += "/"
+		} else {
+			name += "\""
+		}
+		candidates = append(candidates, dir+name)
+	}
+	return candidates
+}
+
+// evaluateInterruptibly evaluates `expr`, cancelling the evaluation if an interrupt is received.
+func evaluateInterruptibly(eval *interp.Interpreter, expr sexpr.SExpr, interrupts chan os.Signal) (sexpr.SExpr, error) {
+	// an interrupt received while no expression was being evaluated is ignored
+	select {
+	case <-interrupts:
+	default:
+	}
+	// the context is only cancelled by an interrupt, as tasks and actors started by `expr` may outlive the evaluation
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-interrupts:
+			cancel()
+		case <-done:
+		}
+	}()
+	return eval.EvaluateContext(ctx, expr)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/zfjagann/gamma/interp"
+	"github.com/zfjagann/gamma/parse"
+	"github.com/zfjagann/gamma/sexpr"
+)
+
+func TestEvaluateInterruptiblyTaskOutlivesLine(t *testing.T) {
+	eval := interp.NewInterpreter(interp.DefaultEnvironment)
+	interrupts := make(chan os.Signal, 1)
+	for _, line := range []string{
+		"(define c (make-channel 1))",
+		"(define t (pexec (channel-receive c)))",
+		"(channel-send c 'a)",
+	} {
+		evaluateLine(t, eval, line, interrupts)
+	}
+	if result := evaluateLine(t, eval, "(t)", interrupts); !sexpr.IsEq(result, sexpr.Symbol("a")) {
+		t.Fatalf("Expected a but was %v", result)
+	}
+}
+
+func evaluateLine(t *testing.T, eval *interp.Interpreter, line string, interrupts chan os.Signal) sexpr.SExpr {
+	expr, err := parse.Parse(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := evaluateInterruptibly(eval, expr, interrupts)
+	if err != nil {
+		t.Fatalf("%s: %v", line, err)
+	}
+	return result
+}
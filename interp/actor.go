@@ -0,0 +1,275 @@
+package interp
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/zfjagann/gamma/sexpr"
+)
+
+var (
+	receiveLiteral  SExpr = Symbol("receive")
+	wildcardLiteral SExpr = Symbol("_")
+	exitLiteral     SExpr = Symbol("exit")
+
+	// The built-in which performs the receive once the clauses have been evaluated
+	receiveInvariant SExpr = Invariant("receive")
+)
+
+var lastPid int64
+
+// Process is an actor with a mailbox, started by spawn.
+type Process struct {
+	id int64
+
+	mu      sync.Mutex
+	mailbox []SExpr
+	arrived chan struct{} // closed and replaced whenever a message is delivered
+	links   map[*Process]bool
+}
+
+func newProcess() *Process {
+	return &Process{
+		id:      atomic.AddInt64(&lastPid, 1),
+		arrived: make(chan struct{}),
+		links:   make(map[*Process]bool),
+	}
+}
+
+func (p *Process) IsEq(other Comparable) bool {
+	otherp, ok := other.(*Process)
+	return ok && p == otherp
+}
+
+func (p *Process) String() string {
+	return fmt.Sprintf("<pid %d>", p.id)
+}
+
+// deliver adds `msg` to the mailbox of the process, charging it to the budget `b` of the sender
+func (p *Process) deliver(msg SExpr, b *budget) {
+	b.alloc(allocSlot, 1)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mailbox = append(p.mailbox, msg)
+	close(p.arrived)
+	p.arrived = make(chan struct{})
+}
+
+// link links two processes, so that each is notified if the other fails
+func (p *Process) link(other *Process) {
+	if p == other {
+		return
+	}
+	p.mu.Lock()
+	p.links[other] = true
+	p.mu.Unlock()
+	other.mu.Lock()
+	other.links[p] = true
+	other.mu.Unlock()
+}
+
+// ExitReason is the REASON of an `(exit PID REASON)` message: the error which made a process fail.
+type ExitReason struct {
+	Err error
+}
+
+func (r *ExitReason) String() string {
+	return fmt.Sprintf("<exit %v>", r.Err)
+}
+
+// fail sends `(exit PID REASON)` to every process linked to `p`
+func (p *Process) fail(err error) {
+	p.mu.Lock()
+	links := make([]*Process, 0, len(p.links))
+	for other := range p.links {
+		links = append(links, other)
+	}
+	p.mu.Unlock()
+	msg := List(exitLiteral, p, &ExitReason{err})
+	for _, other := range links {
+		// exit messages are charged to no budget, as the failed process has stopped
+		other.deliver(msg, nil)
+	}
+}
+
+// take removes the first message in the mailbox which matches one of `patterns`.
+// Returns the index of the matching pattern and the values of its variables.
+// If no message matches, returns -1 and a channel which is closed when the next message arrives.
+func (p *Process) take(patterns []SExpr) (int, []SExpr, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for checked, msg := range p.mailbox {
+		for i, pattern := range patterns {
+			bindings := map[Symbol]SExpr{}
+			if match(pattern, msg, bindings) {
+				p.mailbox = append(p.mailbox[:checked], p.mailbox[checked+1:]...)
+				values := []SExpr{}
+				for _, sym := range patternVars(pattern) {
+					values = append(values, bindings[sym.(Symbol)])
+				}
+				return i, values, nil
+			}
+		}
+	}
+	return -1, nil, p.arrived
+}
+
+func toProcess(rator, e SExpr) (*Process, error) {
+	p, ok := e.(*Process)
+	if !ok {
+		return nil, &TypeError{Proc: rator, Expected: "a process", Value: e}
+	}
+	return p, nil
+}
+
+type processKey struct{}
+
+// currentProcess returns the process evaluating with `ctx`.
+// Evaluations which were not started by spawn share the main process of the interpreter.
+func (in *Interpreter) currentProcess(ctx context.Context) *Process {
+	if p, ok := ctx.Value(processKey{}).(*Process); ok {
+		return p
+	}
+	return in.main
+}
+
+// spawn starts a new process which calls `thunk`. If `link` is true, the new process is linked to the current process.
+func (in *Interpreter) spawn(ctx context.Context, thunk SExpr, link bool) *Process {
+	proc := newProcess()
+	if link {
+		proc.link(in.currentProcess(ctx))
+	}
+	in.makePexec(context.WithValue(ctx, processKey{}, proc), in.globalEnv(), List(Quote(thunk)), proc.fail)
+	return proc
+}
+
+/**
+*** Receive
+**/
+
+// receiveApplication translates a receive block into an application of `receiveInvariant`
+//
+//	(receive (PATTERN BODY)... (after MS BODY))
+//
+// becomes
+//
+//	('receive MS (lambda () BODY) 'PATTERN (lambda (VARS...) BODY)...)
+//
+// where VARS are the variables bound by PATTERN. If there is no after clause, MS and its lambda are #f.
+func receiveApplication(expr SExpr) (SExpr, error) {
+	var timeout, timeoutBody SExpr = False, False
+	args := []SExpr{}
+	for clauses := Cdr(expr); !IsNull(clauses); clauses = Cdr(clauses) {
+		if !IsPair(clauses) {
+			return nil, syntaxErrorf(expr, "invalid receive block: %v", expr)
+		}
+		clause := Car(clauses)
+		if IsEq(Car(clause), afterLiteral) && randLength(clause) == 3 {
+			if timeoutBody != False {
+				return nil, syntaxErrorf(expr, "multiple after clauses in receive block: %v", expr)
+			}
+			timeout = Cadr(clause)
+			timeoutBody = List(lambdaLiteral, Null, Caddr(clause))
+		} else if randLength(clause) == 2 {
+			pattern := Car(clause)
+			args = append(args, Quote(pattern), List(lambdaLiteral, List(patternVars(pattern)...), Cadr(clause)))
+		} else {
+			return nil, syntaxErrorf(clause, "invalid receive clause: %v", clause)
+		}
+	}
+	if len(args) == 0 && timeoutBody == False {
+		return nil, syntaxErrorf(expr, "invalid empty receive block")
+	}
+	return Cons(Quote(receiveInvariant), List(append([]SExpr{timeout, timeoutBody}, args...)...)), nil
+}
+
+// receiveMessage waits for a message matching the patterns in `randList`.
+// Returns the handler for the pattern and the arguments it should be called with.
+func (in *Interpreter) receiveMessage(ctx context.Context, randList SExpr) (SExpr, SExpr, error) {
+	timeout := time.Duration(-1)
+	if ms, ok := Car(randList).(Integer); ok {
+		timeout = time.Duration(ms) * time.Millisecond
+	} else if Car(randList) != False {
+		return nil, nil, &TypeError{Proc: receiveLiteral, Expected: "a number of milliseconds", Value: Car(randList)}
+	}
+	patterns := []SExpr{}
+	handlers := []SExpr{}
+	for cur := Cddr(randList); !IsNull(cur); cur = Cddr(cur) {
+		patterns = append(patterns, Car(cur))
+		handlers = append(handlers, Cadr(cur))
+	}
+	proc := in.currentProcess(ctx)
+	deadline := time.Now().Add(timeout)
+	for {
+		i, values, arrived := proc.take(patterns)
+		if i >= 0 {
+			return handlers[i], List(values...), nil
+		}
+		remaining := timeout
+		if timeout > 0 && in.sched == nil {
+			remaining = deadline.Sub(time.Now())
+			if remaining < 0 {
+				remaining = 0
+			}
+		}
+		chosen, _, _, err := in.selectCases(ctx, []reflect.SelectCase{recvCase(arrived)}, remaining)
+		if err != nil {
+			return nil, nil, err
+		} else if chosen < 0 {
+			return Cadr(randList), Null, nil
+		}
+	}
+}
+
+/**
+*** Pattern Matching
+**/
+
+// match reports whether `value` matches `pattern`, adding the values of pattern variables to `bindings`.
+//
+// Symbols in a pattern are variables, except for `_` which matches anything.
+// Quoted expressions match values which are structurally equal, and lists match element by element.
+func match(pattern, value SExpr, bindings map[Symbol]SExpr) bool {
+	switch pat := pattern.(type) {
+	case Symbol:
+		if pattern == wildcardLiteral {
+			return true
+		}
+		if bound, ok := bindings[pat]; ok {
+			return IsEqStar(bound, value)
+		}
+		bindings[pat] = value
+		return true
+	case QuotedExpr:
+		return IsEqStar(pat.Expr, value)
+	case *Pair:
+		p, ok := value.(*Pair)
+		return ok && match(pat.Car, p.Car, bindings) && match(pat.Cdr, p.Cdr, bindings)
+	}
+	return IsEq(pattern, value)
+}
+
+// patternVars returns the variables bound by `pattern`, in order of their first appearance.
+func patternVars(pattern SExpr) []SExpr {
+	vars := []SExpr{}
+	seen := map[SExpr]bool{}
+	var walk func(SExpr)
+	walk = func(pattern SExpr) {
+		switch pat := pattern.(type) {
+		case Symbol:
+			if pattern != wildcardLiteral && !seen[pat] {
+				seen[pat] = true
+				vars = append(vars, pat)
+			}
+		case *Pair:
+			walk(pat.Car)
+			walk(pat.Cdr)
+		}
+	}
+	walk(pattern)
+	return vars
+}
@@ -0,0 +1,83 @@
+package interp
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/zfjagann/gamma/sexpr"
+)
+
+// Frame is a call to a closure.
+type Frame struct {
+	Proc *Closure
+	Args SExpr
+	Pos  *Position // the location of the call, or nil if it is not known
+	// Depth is the number of closures being evaluated by the caller. A chain of tail calls has the depth of its first call.
+	Depth int
+}
+
+// Name returns the name the closure was defined as, or "<closure>" if it is anonymous.
+func (f *Frame) Name() string {
+	if f.Proc.Name != nil {
+		return f.Proc.Name.String()
+	}
+	return f.Proc.String()
+}
+
+// String formats the frame as a call, such as `(f 1 2)`
+func (f *Frame) String() string {
+	call := f.Name()
+	for cur := f.Args; IsPair(cur); cur = Cdr(cur) {
+		call += " " + abbreviate(Car(cur).String())
+	}
+	return "(" + call + ")"
+}
+
+// Backtrace lists the closures being evaluated by a thread, innermost first.
+// Tail calls replace the frame of their caller, so only the innermost of a chain of tail calls appears.
+type Backtrace []*Frame
+
+// backtraceSize is the number of frames shown at each end of a long backtrace
+const backtraceSize = 10
+
+func (b Backtrace) String() string {
+	lines := []string{}
+	for i, f := range b {
+		if len(b) > 2*backtraceSize && i == backtraceSize {
+			lines = append(lines, fmt.Sprintf("  ... %d more frames", len(b)-2*backtraceSize))
+		}
+		if len(b) > 2*backtraceSize && i >= backtraceSize && i < len(b)-backtraceSize {
+			continue
+		}
+		line := "  in " + f.String()
+		if f.Pos != nil {
+			line += " at " + f.Pos.String()
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// backtrace returns the frames of the closures in the continuation `C`
+func backtrace(C SExpr) Backtrace {
+	var frames Backtrace
+	for {
+		c, ok := C.(interpContinuation)
+		if !ok {
+			return frames
+		}
+		if c.id == "c18" {
+			frames = append(frames, c.Answer.(*Frame))
+		}
+		C = c.C
+	}
+}
+
+// abbreviate shortens long values in backtraces
+func abbreviate(s string) string {
+	const max = 40
+	if len(s) > max {
+		return s[:max-3] + "..."
+	}
+	return s
+}
@@ -0,0 +1,121 @@
+package interp
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	. "github.com/zfjagann/gamma/sexpr"
+)
+
+var (
+	selectLiteral SExpr = Symbol("select")
+	afterLiteral  SExpr = Symbol("after")
+
+	// The built-in which performs the select once the clauses have been evaluated
+	selectInvariant SExpr = Invariant("select")
+)
+
+// selectApplication translates a select block into an application of `selectInvariant`
+//
+//	(select (CHAN VAR BODY)... (after MS BODY))
+//
+// becomes
+//
+//	('select MS (lambda () BODY) CHAN (lambda (VAR) BODY)...)
+//
+// If there is no after clause, MS and its lambda are #f.
+func selectApplication(expr SExpr) (SExpr, error) {
+	args := []SExpr{}
+	var timeout, timeoutBody SExpr = False, False
+	for clauses := Cdr(expr); !IsNull(clauses); clauses = Cdr(clauses) {
+		if !IsPair(clauses) {
+			return nil, syntaxErrorf(expr, "invalid select block: %v", expr)
+		}
+		clause := Car(clauses)
+		if randLength(clause) != 3 {
+			return nil, syntaxErrorf(clause, "invalid select clause: %v", clause)
+		}
+		if IsEq(Car(clause), afterLiteral) {
+			if timeoutBody != False {
+				return nil, syntaxErrorf(expr, "multiple after clauses in select block: %v", expr)
+			}
+			timeout = Cadr(clause)
+			timeoutBody = List(lambdaLiteral, Null, Caddr(clause))
+		} else {
+			if !IsSymbol(Cadr(clause)) {
+				return nil, syntaxErrorf(clause, "invalid select clause: %v", clause)
+			}
+			args = append(args, Car(clause), List(lambdaLiteral, List(Cadr(clause)), Caddr(clause)))
+		}
+	}
+	if len(args) == 0 && timeoutBody == False {
+		return nil, syntaxErrorf(expr, "invalid empty select block")
+	}
+	return Cons(Quote(selectInvariant), List(append([]SExpr{timeout, timeoutBody}, args...)...)), nil
+}
+
+// selectChannel waits for the first of the channels in `randList` to receive a value.
+// Returns the handler for the channel and the arguments it should be called with.
+func (in *Interpreter) selectChannel(ctx context.Context, randList SExpr) (SExpr, SExpr, error) {
+	timeout := time.Duration(-1)
+	if ms, ok := Car(randList).(Integer); ok {
+		timeout = time.Duration(ms) * time.Millisecond
+	} else if Car(randList) != False {
+		return nil, nil, &TypeError{Proc: selectLiteral, Expected: "a number of milliseconds", Value: Car(randList)}
+	}
+	cases := []reflect.SelectCase{}
+	handlers := []SExpr{}
+	for cur := Cddr(randList); !IsNull(cur); cur = Cddr(cur) {
+		ch, ok := Car(cur).(*Channel)
+		if !ok {
+			return nil, nil, &TypeError{Proc: selectLiteral, Expected: "a channel", Value: Car(cur)}
+		}
+		cases = append(cases, recvCase(ch.C))
+		handlers = append(handlers, Cadr(cur))
+	}
+	chosen, value, ok, err := in.selectCases(ctx, cases, timeout)
+	if err != nil {
+		return nil, nil, err
+	} else if chosen < 0 {
+		return Cadr(randList), Null, nil
+	} else if !ok {
+		return handlers[chosen], List(Null), nil
+	}
+	return handlers[chosen], List(value.Interface().(SExpr)), nil
+}
+
+// channelSend sends `value` on `ch`, giving up if `ctx` is cancelled first.
+func (in *Interpreter) channelSend(ctx context.Context, ch *Channel, value SExpr) (err error) {
+	defer func() {
+		if recover() != nil {
+			err = runtimeErrorf("send on closed channel")
+		}
+	}()
+	_, _, _, err = in.selectCases(ctx, []reflect.SelectCase{{
+		Dir:  reflect.SelectSend,
+		Chan: reflect.ValueOf(ch.C),
+		Send: reflect.ValueOf(&value).Elem(),
+	}}, -1)
+	return err
+}
+
+// channelReceive receives a value from `ch`, giving up if `ctx` is cancelled first.
+// Returns `Null` if the channel is closed.
+func (in *Interpreter) channelReceive(ctx context.Context, ch *Channel) (SExpr, error) {
+	_, value, ok, err := in.selectCases(ctx, []reflect.SelectCase{recvCase(ch.C)}, -1)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return Null, nil
+	}
+	return value.Interface().(SExpr), nil
+}
+
+func toChannel(rator, e SExpr) (*Channel, error) {
+	ch, ok := e.(*Channel)
+	if !ok {
+		return nil, &TypeError{Proc: rator, Expected: "a channel", Value: e}
+	}
+	return ch, nil
+}
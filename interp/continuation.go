@@ -7,7 +7,8 @@ import (
 
 type builtin struct {
 	Invariant
-	f func(SExpr) (SExpr, error)
+	f    func(SExpr) (SExpr, error)
+	pure bool // the procedure has no side effects, so closures which call it can be memoized
 }
 
 type interpContinuation struct {
@@ -24,6 +25,8 @@ type interpContinuation struct {
 	Symbol   SExpr
 	C        SExpr
 	Rator    *Closure
+
+	depth int // the number of continuations in the chain, including this one
 }
 
 func (c interpContinuation) String() string {
@@ -48,54 +51,127 @@ func (c interpContinuation) String() string {
 	return s
 }
 
+// push returns `c` with its depth set, for adding it to the chain of continuations
+func push(c interpContinuation) SExpr {
+	c.depth = depthOf(c.C) + 1
+	return c
+}
+
+// depthOf returns the number of continuations in the chain `C`
+func depthOf(C SExpr) int {
+	if c, ok := C.(interpContinuation); ok {
+		return c.depth
+	}
+	return 0
+}
+
+// frameAt returns the continuation in the chain `C` with the given depth, or nil if the chain is not that deep
+func frameAt(C SExpr, depth int) *interpContinuation {
+	for {
+		c, ok := C.(interpContinuation)
+		if !ok || c.depth < depth {
+			return nil
+		} else if c.depth == depth {
+			return &c
+		}
+		C = c.C
+	}
+}
+
 // The continuation at the start of continuation
 // Equivalent to (lambda (x) x)
 var CID = interpContinuation{id: "cid"}
 
 // Place-holder for a data-less continuation value.
 func NewCTag(tag string, C SExpr) SExpr {
-	return interpContinuation{id: "c" + tag, C: C}
+	return push(interpContinuation{id: "c" + tag, C: C})
 }
 
 // C1 is the recursive call during a function application called after the rator has been evaluated
 // C1 evaluates the parameter list, then calls C2 which calls performs the function call
 func NewC1(expr SExpr, env *Environ, C SExpr) SExpr {
-	return interpContinuation{id: "c1", C: C, Expr: expr, Env: env}
+	return push(interpContinuation{id: "c1", C: C, Expr: expr, Env: env})
 }
 
 // C2 is the continuation from a function application called after the rator and randList have been evaluated
 // C2 applies the function rator to the parameter list `randList`
-func NewC2(answer SExpr, env *Environ, C SExpr) SExpr {
-	return interpContinuation{id: "c2", C: C, Answer: answer, Env: env}
+// `expr` is the application, which is reported as the location of errors in the function call
+func NewC2(answer, expr SExpr, env *Environ, C SExpr) SExpr {
+	return push(interpContinuation{id: "c2", C: C, Answer: answer, Expr: expr, Env: env})
 }
 
 // C3 is the continuation from the recursize case of exprListValue
 func NewC3(exprList SExpr, env *Environ, C SExpr) SExpr {
-	return interpContinuation{id: "c3", C: C, ExprList: exprList, Env: env}
+	return push(interpContinuation{id: "c3", C: C, ExprList: exprList, Env: env})
 }
 
 // C4 is the continuation from the recursive case of exprListValue which performs the
 // cons on the result of the previous two computations
 func NewC4(answer, C SExpr) SExpr {
-	return interpContinuation{id: "c4", C: C, Answer: answer}
+	return push(interpContinuation{id: "c4", C: C, Answer: answer})
 }
 
 // C5 is the continuation from the recurisve case of condValue
 func NewC5(clauses SExpr, env *Environ, C SExpr) SExpr {
-	return interpContinuation{id: "c5", C: C, Clauses: clauses, Env: env}
+	return push(interpContinuation{id: "c5", C: C, Clauses: clauses, Env: env})
 }
 
 // C6 is the continuation called during a closure evaluation with the environment
-func NewC6(rator *Closure, C SExpr) SExpr {
-	return interpContinuation{id: "c6", C: C, Rator: rator}
+// `expr` and `randList` are the application and arguments of the call, which are recorded in its frame
+func NewC6(rator *Closure, expr, randList, C SExpr) SExpr {
+	return push(interpContinuation{id: "c6", C: C, Rator: rator, Expr: expr, RandList: randList})
 }
 
 // C8 is called during a define block with the evaluated expression
 func NewC8(symbol, C SExpr) SExpr {
-	return interpContinuation{id: "c8", C: C, Symbol: symbol}
+	return push(interpContinuation{id: "c8", C: C, Symbol: symbol})
 }
 
 // C9 is called during an if with the evaluated condition
 func NewC9(exprList, C SExpr) SExpr {
-	return interpContinuation{id: "c9", C: C, ExprList: exprList}
+	return push(interpContinuation{id: "c9", C: C, ExprList: exprList})
+}
+
+// C10 is called with the result of a memoized closure to store it in the cache
+func NewC10(memo *Memoized, randList, C SExpr) SExpr {
+	return push(interpContinuation{id: "c10", C: C, Answer: memo, RandList: randList})
+}
+
+// C11 is called during a define-memoized block with the evaluated expression
+func NewC11(symbol, C SExpr) SExpr {
+	return push(interpContinuation{id: "c11", C: C, Symbol: symbol})
+}
+
+// C12 is called after the thunk in a with-mutex block to release the mutex
+func NewC12(hold *mutexHold, C SExpr) SExpr {
+	return push(interpContinuation{id: "c12", C: C, Answer: hold})
+}
+
+// C13 is called during an atomic-swap! with the new value of the atomic
+func NewC13(box *Atomic, proc, randList, C SExpr) SExpr {
+	return push(interpContinuation{id: "c13", C: C, Answer: box, Expr: proc, RandList: randList})
+}
+
+// C14 is called at the end of an atomically block to commit the transaction
+func NewC14(C SExpr) SExpr {
+	return push(interpContinuation{id: "c14", C: C})
+}
+
+// C15 is called when a coroutine returns
+func NewC15(co *Coroutine) SExpr {
+	return push(interpContinuation{id: "c15", Answer: co})
+}
+
+// C16 is called during generator->list with the next value of the generator
+func NewC16(co *Coroutine, values, C SExpr) SExpr {
+	return push(interpContinuation{id: "c16", C: C, Answer: co, ExprList: values})
+}
+
+// C17 is called when a green thread finishes
+var C17 = interpContinuation{id: "c17"}
+
+// C18 marks the evaluation of the body of a closure, and passes its result to the caller
+// `frame` describes the call, for backtraces
+func NewC18(frame *Frame, C SExpr) SExpr {
+	return push(interpContinuation{id: "c18", C: C, Answer: frame})
 }
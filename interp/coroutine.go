@@ -0,0 +1,120 @@
+package interp
+
+import (
+	"sync"
+
+	. "github.com/zfjagann/gamma/sexpr"
+)
+
+type coroutineState int
+
+const (
+	coroutineNew coroutineState = iota
+	coroutineSuspended
+	coroutineRunning
+	coroutineDead
+)
+
+/*
+Type Coroutine is a procedure which can suspend itself with yield, and be resumed where it left off.
+
+Coroutines are implemented with continuations: yield saves the continuation of the coroutine and
+applies the continuation of its caller, and resume does the opposite.
+A coroutine may be resumed from any thread, but only runs on one thread at a time.
+*/
+type Coroutine struct {
+	proc      SExpr
+	generator bool // generators are started without an argument
+
+	mu     sync.Mutex
+	state  coroutineState
+	saved  SExpr      // the continuation of the suspended coroutine
+	caller SExpr      // the continuation of the resume which is running the coroutine
+	prev   *Coroutine // the coroutine which was running when this coroutine was resumed
+}
+
+func (co *Coroutine) String() string {
+	if co.generator {
+		return "<generator>"
+	}
+	return "<coroutine>"
+}
+
+// resume marks the coroutine as running, called by `prev` with the continuation `C`.
+// It returns the state the coroutine was in, and its saved continuation if it was suspended.
+func (co *Coroutine) resume(C SExpr, prev *Coroutine) (coroutineState, SExpr, error) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	switch co.state {
+	case coroutineRunning:
+		return co.state, nil, runtimeErrorf("resume of running coroutine")
+	case coroutineDead:
+		return co.state, nil, runtimeErrorf("resume of dead coroutine")
+	}
+	state := co.state
+	co.state = coroutineRunning
+	co.caller = C
+	co.prev = prev
+	return state, co.saved, nil
+}
+
+// suspend saves the continuation `C` of the coroutine, and returns the continuation
+// of its caller and the coroutine which resumed it.
+func (co *Coroutine) suspend(C SExpr) (SExpr, *Coroutine) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	co.state = coroutineSuspended
+	co.saved = C
+	return co.caller, co.prev
+}
+
+// finish marks the coroutine as dead, and returns the continuation of its caller and the coroutine which resumed it.
+func (co *Coroutine) finish() (SExpr, *Coroutine) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	co.state = coroutineDead
+	co.saved = nil
+	return co.caller, co.prev
+}
+
+// abandon marks the coroutine and those which resumed it as dead, if they are still running
+// when the evaluation running them ends.
+func (co *Coroutine) abandon() {
+	for ; co != nil; co = co.prev {
+		co.mu.Lock()
+		if co.state == coroutineRunning {
+			co.state = coroutineDead
+		}
+		co.mu.Unlock()
+	}
+}
+
+func (co *Coroutine) done() bool {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	return co.state == coroutineDead
+}
+
+func toCoroutine(rator, e SExpr) (*Coroutine, error) {
+	co, ok := e.(*Coroutine)
+	if !ok {
+		return nil, &TypeError{Proc: rator, Expected: "a coroutine", Value: e}
+	}
+	return co, nil
+}
+
+// greenThread is a thread waiting in the queue of thread-yield
+type greenThread struct {
+	thunk   SExpr      // the thunk of a thread which has not started yet
+	C       SExpr      // the continuation of a thread which has yielded
+	current *Coroutine // the coroutine which was running when the thread yielded
+}
+
+// reverse returns the elements of `list` in reverse order
+func reverse(list SExpr) SExpr {
+	result := Null
+	for cur := list; !IsNull(cur); cur = Cdr(cur) {
+		result = Cons(Car(cur), result)
+	}
+	return result
+}
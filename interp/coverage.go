@@ -0,0 +1,348 @@
+package interp
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/zfjagann/gamma/sexpr"
+)
+
+/*
+Coverage records which expressions of the source code registered with Register are evaluated. It is attached with WithCoverage,
+which also registers every expression given to Evaluate.
+
+Every list expression read by the parser is covered when it is evaluated.
+The branches of `if` and the clauses of `cond` are covered when they are chosen, including branches which are not lists,
+such as `(if (null? x) 'empty x)`. Atoms and symbols outside of branches are not counted.
+*/
+type Coverage struct {
+	mu    sync.RWMutex
+	spans map[Position]*coverSpan // keyed by the start of the span
+	order []*coverSpan            // in the order they were registered
+}
+
+// coverSpan is an expression in source code, from `start` up to `end`
+type coverSpan struct {
+	start, end Position
+	branch     bool  // an arm of if or a clause of cond
+	count      int64 // the number of times it was evaluated
+}
+
+func (s *coverSpan) evaluated() int64 {
+	return atomic.LoadInt64(&s.count)
+}
+
+func NewCoverage() *Coverage {
+	return &Coverage{spans: map[Position]*coverSpan{}}
+}
+
+// WithCoverage makes the interpreter record the expressions it evaluates in `c`.
+func WithCoverage(c *Coverage) Option {
+	return func(in *Interpreter) {
+		in.coverage = c
+	}
+}
+
+// Register adds the expressions of `expr`, which should have been read by the parser, to the coverage report.
+func (c *Coverage) Register(expr SExpr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.walk(expr)
+}
+
+// add registers `pair` as a span. The caller must hold `mu`.
+func (c *Coverage) add(pair *Pair, branch bool) {
+	if pair.Pos == nil || pair.End == nil {
+		return
+	}
+	if _, ok := c.spans[*pair.Pos]; ok {
+		// a branch which is a list starts at the same place as the list
+		return
+	}
+	s := &coverSpan{start: *pair.Pos, end: *pair.End, branch: branch}
+	c.spans[s.start] = s
+	c.order = append(c.order, s)
+}
+
+// listCells returns the pairs which make up the list `expr`
+func listCells(expr SExpr) []*Pair {
+	var cells []*Pair
+	for cur, ok := expr.(*Pair); ok; cur, ok = cur.Cdr.(*Pair) {
+		cells = append(cells, cur)
+	}
+	return cells
+}
+
+// walk registers the expression `expr` and its subexpressions, skipping the parts of special forms which are not evaluated
+func (c *Coverage) walk(expr SExpr) {
+	pair, ok := expr.(*Pair)
+	if !ok {
+		return
+	}
+	c.add(pair, false)
+	cells := listCells(pair)
+	switch {
+	case IsEq(pair.Car, lambdaLiteral), IsEq(pair.Car, defineLiteral), IsEq(pair.Car, defineMemoizedLiteral):
+		// the parameter list or symbol is not evaluated
+		for i := 2; i < len(cells); i++ {
+			c.walk(cells[i].Car)
+		}
+	case IsEq(pair.Car, ifLiteral):
+		for i := 1; i < len(cells); i++ {
+			if i > 1 {
+				c.add(cells[i], true)
+			}
+			c.walk(cells[i].Car)
+		}
+	case IsEq(pair.Car, condLiteral):
+		for _, cell := range cells[1:] {
+			clause, ok := cell.Car.(*Pair)
+			if !ok {
+				continue
+			}
+			c.add(clause, true)
+			for i, part := range listCells(clause) {
+				if i > 0 || !IsEq(part.Car, elseLiteral) {
+					c.walk(part.Car)
+				}
+			}
+		}
+	case IsEq(pair.Car, checkPropertyLiteral):
+		// the bindings are not evaluated, but their generators and the body are
+		if len(cells) < 3 {
+			return
+		}
+		for _, binding := range listCells(cells[len(cells)-2].Car) {
+			if parts := listCells(binding.Car); len(parts) == 2 {
+				c.walk(parts[1].Car)
+			}
+		}
+		c.walk(cells[len(cells)-1].Car)
+	case IsEq(pair.Car, selectLiteral), IsEq(pair.Car, receiveLiteral):
+		// the clauses are rewritten before they are evaluated, so only the form itself is covered
+	default:
+		// applications and pexec
+		for _, cell := range cells {
+			c.walk(cell.Car)
+		}
+	}
+}
+
+// mark records the evaluation of `expr`, if it is a registered span. A nil Coverage records nothing.
+func (c *Coverage) mark(expr SExpr) {
+	if c == nil {
+		return
+	}
+	pos := PosOf(expr)
+	if pos == nil {
+		return
+	}
+	c.mu.RLock()
+	s := c.spans[*pos]
+	c.mu.RUnlock()
+	if s != nil {
+		atomic.AddInt64(&s.count, 1)
+	}
+}
+
+// files returns the spans of each file, in order of their start, and the names of the files in the order they were registered
+func (c *Coverage) files() (map[string][]*coverSpan, []string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	files := map[string][]*coverSpan{}
+	names := []string{}
+	for _, s := range c.order {
+		if _, ok := files[s.start.File]; !ok {
+			names = append(names, s.start.File)
+		}
+		files[s.start.File] = append(files[s.start.File], s)
+	}
+	for _, spans := range files {
+		sort.SliceStable(spans, func(i, j int) bool {
+			if spans[i].start != spans[j].start {
+				return before(spans[i].start, spans[j].start)
+			}
+			// enclosing spans first
+			return before(spans[j].end, spans[i].end)
+		})
+	}
+	return files, names
+}
+
+func before(a, b Position) bool {
+	return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+}
+
+func percentOf(n, total int) string {
+	if total == 0 {
+		return "100.0%"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
+
+/*
+WriteSummary writes the percentage of the expressions and branches of each file which were evaluated,
+followed by the expressions which were not evaluated. Expressions within an expression which was not evaluated are not listed.
+*/
+func (c *Coverage) WriteSummary(w io.Writer) error {
+	files, names := c.files()
+	var totalExprs, coveredExprs int
+	var uncovered []*coverSpan
+	for _, name := range names {
+		var exprs, covered, branches, coveredBranches int
+		var outer *coverSpan // the last span which was not evaluated
+		for _, s := range files[name] {
+			exprs++
+			if s.branch {
+				branches++
+			}
+			if s.evaluated() > 0 {
+				covered++
+				if s.branch {
+					coveredBranches++
+				}
+			} else if outer == nil || !before(s.start, outer.end) {
+				outer = s
+				uncovered = append(uncovered, s)
+			}
+		}
+		totalExprs += exprs
+		coveredExprs += covered
+		if name == "" {
+			name = "<input>"
+		}
+		if _, err := fmt.Fprintf(w, "%s: %s of %d expressions, %d of %d branches\n",
+			name, percentOf(covered, exprs), exprs, coveredBranches, branches); err != nil {
+			return err
+		}
+	}
+	if len(names) > 1 {
+		if _, err := fmt.Fprintf(w, "total: %s of %d expressions\n", percentOf(coveredExprs, totalExprs), totalExprs); err != nil {
+			return err
+		}
+	}
+	if len(uncovered) > 0 {
+		fmt.Fprintln(w, "not evaluated:")
+	}
+	for _, s := range uncovered {
+		kind := ""
+		if s.branch {
+			kind = " (branch)"
+		}
+		if _, err := fmt.Fprintf(w, "  %v%s\n", s.start, kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const coverageHTMLHeader = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>gamma coverage</title>
+<style>
+body { font-family: sans-serif; }
+pre { font-family: monospace; background: #f8f8f8; padding: 1em; }
+.cov { background: #c8f0c8; }
+.uncov { background: #f8c0c0; }
+</style>
+</head>
+<body>
+`
+
+// WriteHTML writes an HTML page with the source of each file, highlighting the expressions which were and were not evaluated.
+// The files are read when the page is written. Source which was not read from a file cannot be shown.
+func (c *Coverage) WriteHTML(w io.Writer) error {
+	files, names := c.files()
+	var b strings.Builder
+	b.WriteString(coverageHTMLHeader)
+	for _, name := range names {
+		spans := files[name]
+		covered := 0
+		for _, s := range spans {
+			if s.evaluated() > 0 {
+				covered++
+			}
+		}
+		fmt.Fprintf(&b, "<h2>%s: %s</h2>\n", html.EscapeString(name), percentOf(covered, len(spans)))
+		if name == "" {
+			continue
+		}
+		source, err := ioutil.ReadFile(name)
+		if err != nil {
+			fmt.Fprintf(&b, "<p>%s</p>\n", html.EscapeString(err.Error()))
+			continue
+		}
+		b.WriteString("<pre>")
+		writeCoveredSource(&b, string(source), spans)
+		b.WriteString("</pre>\n")
+	}
+	b.WriteString("</body>\n</html>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeCoveredSource writes `source` as HTML, with each rune in the innermost span which contains it
+func writeCoveredSource(b *strings.Builder, source string, spans []*coverSpan) {
+	lines := [][]rune{}
+	for _, line := range strings.Split(source, "\n") {
+		lines = append(lines, []rune(line))
+	}
+	// the span of each rune, filled from the outermost spans to the innermost
+	inner := make([][]*coverSpan, len(lines))
+	for i, line := range lines {
+		inner[i] = make([]*coverSpan, len(line))
+	}
+	for _, s := range spans {
+		for l := s.start.Line; l <= s.end.Line && l <= len(lines); l++ {
+			from, to := 1, len(lines[l-1])+1
+			if l == s.start.Line {
+				from = s.start.Column
+			}
+			if l == s.end.Line {
+				to = s.end.Column
+			}
+			for col := from; col < to && col <= len(lines[l-1]); col++ {
+				inner[l-1][col-1] = s
+			}
+		}
+	}
+
+	// adjacent runes with the same count are written in the same element
+	current := ""
+	for i, line := range lines {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		for j, r := range line {
+			tag := ""
+			if s := inner[i][j]; s != nil {
+				class := "cov"
+				if s.evaluated() == 0 {
+					class = "uncov"
+				}
+				tag = fmt.Sprintf(`<span class="%s" title="evaluated %d times">`, class, s.evaluated())
+			}
+			if tag != current {
+				if current != "" {
+					b.WriteString("</span>")
+				}
+				b.WriteString(tag)
+				current = tag
+			}
+			b.WriteString(html.EscapeString(string(r)))
+		}
+		if current != "" {
+			// elements are closed at the end of each line
+			b.WriteString("</span>")
+			current = ""
+		}
+	}
+}
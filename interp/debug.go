@@ -0,0 +1,335 @@
+package interp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zfjagann/gamma/parse"
+	. "github.com/zfjagann/gamma/sexpr"
+)
+
+// Quit is returned when the user quits the debugger.
+var Quit error = fmt.Errorf("debugger quit")
+
+type stepMode int
+
+const (
+	stepInto     stepMode = iota // stop at the next step
+	stepOver                     // stop at the next step which is not nested in the current one
+	stepOut                      // stop when the current closure returns
+	stepContinue                 // stop at the next breakpoint
+)
+
+/*
+Type Debugger is an interactive debugger, which reads commands from an input stream and writes to an output stream.
+
+The debugger stops the evaluation before each expression is evaluated, and after each value is computed,
+which are the exprValue and applyC steps of the interpreter. It starts by stopping at the first step.
+See the help command for the commands it accepts.
+*/
+type Debugger struct {
+	mu     sync.Mutex
+	input  *bufio.Scanner
+	output io.Writer
+
+	mode   stepMode
+	target int // the depth of continuation at which stepOver and stepOut stop
+
+	breakpoints []breakpoint
+	lastLine    int  // the line of the last expression evaluated, so that line breakpoints trigger once per visit
+	breakNext   bool // set by the break primitive
+	lastCommand string
+}
+
+// breakpoint stops on entry to closures defined as `name`, or on expressions at `line` of `file`
+type breakpoint struct {
+	name Symbol
+	file string
+	line int
+}
+
+func (b breakpoint) String() string {
+	if b.name != "" {
+		return string(b.name)
+	} else if b.file != "" {
+		return fmt.Sprintf("%s:%d", b.file, b.line)
+	}
+	return fmt.Sprintf("line %d", b.line)
+}
+
+// debugStep is a step of evaluation at which the debugger may stop
+type debugStep struct {
+	in     *Interpreter
+	ctx    context.Context
+	eval   bool  // true before evaluating `expr`, false after computing `answer`
+	expr   SExpr // the expression being evaluated
+	answer SExpr
+	env    *Environ
+	C      SExpr
+}
+
+func NewDebugger(input io.Reader, output io.Writer) *Debugger {
+	return &Debugger{input: bufio.NewScanner(input), output: output}
+}
+
+// WithDebugger runs every evaluation of the interpreter under the debugger `d`.
+func WithDebugger(d *Debugger) Option {
+	return func(in *Interpreter) {
+		in.debugger = d
+	}
+}
+
+type debuggerKey struct{}
+
+func debuggerFromContext(ctx context.Context) *Debugger {
+	d, _ := ctx.Value(debuggerKey{}).(*Debugger)
+	return d
+}
+
+// breakNow makes the debugger stop at the next step.
+func (d *Debugger) breakNow() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.breakNext = true
+}
+
+// step is called by the interpreter at every step. It returns Quit if the user quits.
+func (d *Debugger) step(s debugStep) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.shouldStop(s) {
+		return nil
+	}
+	d.mode = stepContinue
+	d.breakNext = false
+	d.show(s)
+	return d.prompt(s)
+}
+
+func (d *Debugger) shouldStop(s debugStep) bool {
+	depth := depthOf(s.C)
+	line := 0
+	if pos := PosOf(s.expr); s.eval && pos != nil {
+		line = pos.Line
+	}
+	changedLine := line != 0 && line != d.lastLine
+	if line != 0 {
+		d.lastLine = line
+	}
+
+	if d.breakNext {
+		return true
+	}
+	switch d.mode {
+	case stepInto:
+		return true
+	case stepOver:
+		if depth <= d.target {
+			return true
+		}
+	case stepOut:
+		if !s.eval && depth < d.target {
+			return true
+		}
+	}
+	for _, b := range d.breakpoints {
+		if b.name != "" && s.eval {
+			if frame := enteredFrame(s); frame != nil && IsEq(frame.Proc.Name, b.name) {
+				return true
+			}
+		} else if b.line != 0 && changedLine && line == b.line {
+			if pos := PosOf(s.expr); b.file == "" || pos.File == b.file {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// enteredFrame returns the frame of the closure whose body is about to be evaluated by `s`, or nil.
+func enteredFrame(s debugStep) *Frame {
+	c, ok := s.C.(interpContinuation)
+	if !ok || c.id != "c18" {
+		return nil
+	}
+	frame := c.Answer.(*Frame)
+	if s.expr != frame.Proc.Body {
+		return nil
+	}
+	return frame
+}
+
+// show describes the step at which the debugger stopped
+func (d *Debugger) show(s debugStep) {
+	if !s.eval {
+		fmt.Fprintf(d.output, "=> %v\n", abbreviate(s.answer.String()))
+	} else if pos := PosOf(s.expr); pos != nil {
+		fmt.Fprintf(d.output, "%v: %v\n", pos, abbreviate(s.expr.String()))
+	} else {
+		fmt.Fprintf(d.output, "%v\n", abbreviate(s.expr.String()))
+	}
+}
+
+const debugHelp = `Commands:
+  s, step             stop at the next step
+  n, next             step over the current expression
+  o, out              continue until the current closure returns
+  c, continue         continue until a breakpoint or (break)
+  b, break [NAME|LINE|FILE:LINE]
+                      stop when the closure NAME is called, or at a line; list breakpoints without an argument
+  d, delete [N]       delete breakpoint N, or all breakpoints
+  bt, backtrace       print the closures being called
+  l, locals           print the local variables
+  p, print EXPR       evaluate EXPR in the current environment
+  w, where            show the current step
+  q, quit             stop the evaluation
+An empty line repeats the last command.`
+
+// prompt reads and runs commands until one of them resumes the evaluation
+func (d *Debugger) prompt(s debugStep) error {
+	for {
+		fmt.Fprint(d.output, "(debug) ")
+		if !d.input.Scan() {
+			fmt.Fprintln(d.output)
+			return Quit
+		}
+		line := strings.TrimSpace(d.input.Text())
+		if line == "" {
+			line = d.lastCommand
+		}
+		d.lastCommand = line
+		command, arg := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			command, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		switch command {
+		case "s", "step":
+			d.mode = stepInto
+			return nil
+		case "n", "next":
+			d.mode = stepOver
+			d.target = depthOf(s.C)
+			return nil
+		case "o", "out":
+			d.mode = stepOut
+			d.target = frameDepth(s.C)
+			return nil
+		case "c", "continue":
+			d.mode = stepContinue
+			return nil
+		case "q", "quit":
+			return Quit
+		case "b", "break":
+			d.addBreakpoint(arg)
+		case "d", "delete":
+			d.deleteBreakpoint(arg)
+		case "bt", "backtrace":
+			if bt := backtrace(s.C); len(bt) > 0 {
+				fmt.Fprintln(d.output, bt)
+			} else {
+				fmt.Fprintln(d.output, "  at top level")
+			}
+		case "l", "locals":
+			d.printLocals(s)
+		case "p", "print":
+			d.print(s, arg)
+		case "w", "where":
+			d.show(s)
+		case "h", "help":
+			fmt.Fprintln(d.output, debugHelp)
+		default:
+			fmt.Fprintf(d.output, "unknown command %q, type help for a list of commands\n", command)
+		}
+	}
+}
+
+// frameDepth returns the depth of the innermost closure call in `C`, or 0 at the top level
+func frameDepth(C SExpr) int {
+	for {
+		c, ok := C.(interpContinuation)
+		if !ok {
+			return 0
+		}
+		if c.id == "c18" {
+			return c.depth
+		}
+		C = c.C
+	}
+}
+
+func (d *Debugger) addBreakpoint(arg string) {
+	if arg == "" {
+		for i, b := range d.breakpoints {
+			fmt.Fprintf(d.output, "  %d: %v\n", i+1, b)
+		}
+		return
+	}
+	var b breakpoint
+	file, lineStr := "", arg
+	if i := strings.LastIndex(arg, ":"); i >= 0 {
+		file, lineStr = arg[:i], arg[i+1:]
+	}
+	if line, err := strconv.Atoi(lineStr); err == nil {
+		b = breakpoint{file: file, line: line}
+	} else {
+		b = breakpoint{name: Symbol(arg)}
+	}
+	d.breakpoints = append(d.breakpoints, b)
+	fmt.Fprintf(d.output, "breakpoint %d at %v\n", len(d.breakpoints), b)
+}
+
+func (d *Debugger) deleteBreakpoint(arg string) {
+	if arg == "" {
+		d.breakpoints = nil
+		return
+	}
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(d.breakpoints) {
+		fmt.Fprintf(d.output, "no breakpoint %s\n", arg)
+		return
+	}
+	d.breakpoints = append(d.breakpoints[:n-1], d.breakpoints[n:]...)
+}
+
+// printLocals prints the bindings of the current environment which are not global
+func (d *Debugger) printLocals(s debugStep) {
+	// closures capture an earlier global environment, which is a tail of the current one
+	global := map[SExpr]bool{}
+	for cur := s.in.globalEnv().Value; !IsNull(cur); cur = Cdr(cur) {
+		global[cur] = true
+	}
+	seen := map[SExpr]bool{}
+	for cur := s.env.Value; !IsNull(cur) && !global[cur]; cur = Cdr(cur) {
+		sym, value := Caar(cur), Cdar(cur)
+		if clos, ok := value.(*Closure); ok && clos.Name == sym {
+			// the binding of a defined closure to itself
+			continue
+		}
+		if !seen[sym] {
+			seen[sym] = true
+			fmt.Fprintf(d.output, "  %v = %v\n", sym, abbreviate(value.String()))
+		}
+	}
+}
+
+// print evaluates `input` in the environment of the step, without the debugger
+func (d *Debugger) print(s debugStep, input string) {
+	expr, err := parse.Parse(input)
+	if err != nil {
+		fmt.Fprintln(d.output, err)
+		return
+	}
+	ctx := context.WithValue(s.ctx, debuggerKey{}, (*Debugger)(nil))
+	result, err := s.in.schemeValue(ctx, s.env, newInterpStack(), expr)
+	if err != nil {
+		fmt.Fprintln(d.output, err)
+	} else {
+		fmt.Fprintln(d.output, result)
+	}
+}
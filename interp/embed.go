@@ -0,0 +1,179 @@
+package interp
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	. "github.com/zfjagann/gamma/sexpr"
+)
+
+// Func is the signature of a Go function which can be called directly as a gamma procedure.
+type Func func(args ...SExpr) (SExpr, error)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// WithFunc defines `name` as a procedure which calls `fn`. See NewBuiltin.
+// Panics if `fn` is not a function.
+func WithFunc(name string, fn interface{}) Option {
+	return func(in *Interpreter) {
+		b, err := NewBuiltin(name, fn)
+		if err != nil {
+			panic(err)
+		}
+		in.env = in.env.Put(Symbol(name), b)
+	}
+}
+
+// WithPureFunc is like WithFunc, but the procedure may be called by memoized closures. See NewPureBuiltin.
+func WithPureFunc(name string, fn interface{}) Option {
+	return func(in *Interpreter) {
+		b, err := NewPureBuiltin(name, fn)
+		if err != nil {
+			panic(err)
+		}
+		in.env = in.env.Put(Symbol(name), b)
+	}
+}
+
+// Define binds `name` to `value` in the global environment.
+func (in *Interpreter) Define(name string, value SExpr) {
+	in.define(Symbol(name), value)
+}
+
+// Names returns the names bound in the global environment, sorted, including those defined since the interpreter was created.
+func (in *Interpreter) Names() []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for cur := in.globalEnv().Value; !IsNull(cur); cur = Cdr(cur) {
+		if sym, ok := Caar(cur).(Symbol); ok && !seen[string(sym)] {
+			seen[string(sym)] = true
+			names = append(names, string(sym))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+NewBuiltin returns a gamma procedure named `name` which calls `fn`.
+
+If `fn` is a Func, or has the same signature, it is called with the arguments of the procedure.
+
+Otherwise `fn` may be any function. Each argument is converted to the type of the corresponding parameter
+with ToGo, and any value can be passed to a parameter of type SExpr. Variadic functions are supported.
+Calling the procedure with the wrong number of arguments, or arguments that cannot be converted, is an error.
+
+`fn` may return nothing, a value, an error, or a value and an error.
+Returned values are converted to gamma values with FromGo, with nothing returning `<null>`.
+
+The procedure is assumed to have side effects, such as I/O, so closures which call it cannot be memoized.
+*/
+func NewBuiltin(name string, fn interface{}) (SExpr, error) {
+	f, err := builtinFunc(name, fn)
+	if err != nil {
+		return nil, err
+	}
+	return builtin{Invariant: Invariant(name), f: f}, nil
+}
+
+// NewPureBuiltin is like NewBuiltin, but the procedure may be called by memoized closures.
+// `fn` must always return the same result for the same arguments, and have no side effects.
+func NewPureBuiltin(name string, fn interface{}) (SExpr, error) {
+	f, err := builtinFunc(name, fn)
+	if err != nil {
+		return nil, err
+	}
+	return builtin{Invariant: Invariant(name), f: f, pure: true}, nil
+}
+
+// builtinFunc returns the function which applies `fn` to the arguments of the procedure `name`
+func builtinFunc(name string, fn interface{}) (func(SExpr) (SExpr, error), error) {
+	switch f := fn.(type) {
+	case Func:
+		return wrapFunc(Invariant(name), f), nil
+	case func(args ...SExpr) (SExpr, error):
+		return wrapFunc(Invariant(name), f), nil
+	}
+
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		return nil, fmt.Errorf("cannot define %s: %T is not a function", name, fn)
+	}
+	t := v.Type()
+	switch {
+	case t.NumOut() > 2,
+		t.NumOut() == 2 && t.Out(1) != errorType:
+		return nil, fmt.Errorf("cannot define %s: %v must return at most a value and an error", name, t)
+	}
+	rator := Invariant(name)
+	return func(randList SExpr) (SExpr, error) {
+		args, err := listToSlice(rator, randList)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkArity(t, rator, len(args)); err != nil {
+			return nil, err
+		}
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			paramType := paramType(t, i)
+			in[i], err = toGoValue(arg, paramType)
+			if err != nil {
+				return nil, fmt.Errorf("%v argument %d: %v", rator, i+1, err)
+			}
+		}
+		return fromGoResults(v.Call(in))
+	}, nil
+}
+
+func wrapFunc(rator SExpr, f Func) func(SExpr) (SExpr, error) {
+	return func(randList SExpr) (SExpr, error) {
+		args, err := listToSlice(rator, randList)
+		if err != nil {
+			return nil, err
+		}
+		return f(args...)
+	}
+}
+
+func checkArity(t reflect.Type, rator SExpr, actual int) error {
+	if t.IsVariadic() {
+		if actual < t.NumIn()-1 {
+			return &ArityError{Proc: rator, Expected: t.NumIn() - 1, Variadic: true, Actual: actual}
+		}
+	} else if actual != t.NumIn() {
+		return &ArityError{Proc: rator, Expected: t.NumIn(), Actual: actual}
+	}
+	return nil
+}
+
+// paramType returns the type of the i'th argument to a function of type `t`
+func paramType(t reflect.Type, i int) reflect.Type {
+	if t.IsVariadic() && i >= t.NumIn()-1 {
+		return t.In(t.NumIn() - 1).Elem()
+	}
+	return t.In(i)
+}
+
+func fromGoResults(out []reflect.Value) (SExpr, error) {
+	if len(out) > 0 && out[len(out)-1].Type() == errorType {
+		if err, _ := out[len(out)-1].Interface().(error); err != nil {
+			return nil, err
+		}
+		out = out[:len(out)-1]
+	}
+	if len(out) == 0 {
+		return Null, nil
+	}
+	return FromGo(out[0].Interface())
+}
+
+// toGoValue converts `e` to a Go value of type `t`
+func toGoValue(e SExpr, t reflect.Type) (reflect.Value, error) {
+	v := reflect.New(t)
+	if err := ToGo(e, v.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+	return v.Elem(), nil
+}
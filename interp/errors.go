@@ -0,0 +1,182 @@
+package interp
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	. "github.com/zfjagann/gamma/sexpr"
+)
+
+/*
+ErrorContext describes where an error occurred. It is embedded in the errors returned by the interpreter.
+
+Expr is the expression being evaluated when the error occurred, usually the application or special form which failed.
+Pos is its location in source code, or nil if the expression was not read by the parser.
+Stack is the interpreter trace of the thread which failed, and Backtrace lists the closures it was evaluating.
+*/
+type ErrorContext struct {
+	Expr      SExpr
+	Pos       *Position
+	Stack     *interpStack
+	Backtrace Backtrace
+}
+
+func (c *ErrorContext) errorContext() *ErrorContext {
+	return c
+}
+
+type contextError interface {
+	error
+	errorContext() *ErrorContext
+}
+
+// ContextOf returns the context of an error returned by the interpreter, or nil if it has none.
+func ContextOf(err error) *ErrorContext {
+	var ce contextError
+	if !errors.As(err, &ce) {
+		return nil
+	}
+	return ce.errorContext()
+}
+
+// annotate returns a copy of `err` with the context which was not known when it was created filled in.
+// `site` is the expression being evaluated when the error occurred, and `C` is the continuation of the evaluation.
+// `err` itself is not changed, as it may be shared with other threads, such as the failure of a pexec.
+// Errors wrapped by `err` were annotated by the thread in which they occurred.
+func annotate(err error, site SExpr, stack *interpStack, C SExpr) error {
+	ce, ok := err.(contextError)
+	if !ok {
+		return err
+	}
+	c := *ce.errorContext()
+	if c.Expr != nil && c.Pos != nil && c.Stack != nil {
+		return err
+	}
+	if c.Expr == nil {
+		c.Expr = site
+	}
+	if c.Pos == nil {
+		c.Pos = PosOf(c.Expr)
+	}
+	if c.Pos == nil {
+		c.Pos = PosOf(site)
+	}
+	if c.Stack == nil {
+		// only the thread in which the error occurred is traced
+		c.Stack = stack
+		c.Backtrace = backtrace(C)
+	}
+	v := reflect.ValueOf(err)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return err
+	}
+	annotated := reflect.New(v.Elem().Type())
+	annotated.Elem().Set(v.Elem())
+	ce = annotated.Interface().(contextError)
+	*ce.errorContext() = c
+	return ce
+}
+
+// UnboundVariableError is returned when a symbol is not bound in the environment.
+type UnboundVariableError struct {
+	Symbol Symbol
+	ErrorContext
+}
+
+func (e *UnboundVariableError) Error() string {
+	return fmt.Sprintf("environment lookup failed for symbol %q", string(e.Symbol))
+}
+
+// ArityError is returned when a procedure is called with the wrong number of arguments.
+type ArityError struct {
+	Proc     SExpr
+	Expected int
+	Variadic bool // the procedure accepts at least Expected arguments
+	Actual   int
+	ErrorContext
+}
+
+func (e *ArityError) Error() string {
+	if e.Variadic {
+		return fmt.Sprintf("%v expects at least %d arguments but was given %d", e.Proc, e.Expected, e.Actual)
+	}
+	return fmt.Sprintf("%v expects %d arguments but was given %d", e.Proc, e.Expected, e.Actual)
+}
+
+// TypeError is returned when a procedure is given a value of the wrong type, or a value which is not a procedure is applied.
+type TypeError struct {
+	Proc     SExpr  // the procedure which was given the value, or nil if the value was applied
+	Expected string // a description of the expected value, such as "a channel"
+	Value    SExpr
+	ErrorContext
+}
+
+func (e *TypeError) Error() string {
+	if e.Proc == nil {
+		return fmt.Sprintf("Unknown operator: %v", e.Value)
+	}
+	return fmt.Sprintf("%v expects %s but was given %v", e.Proc, e.Expected, e.Value)
+}
+
+// SyntaxError is returned when a special form is malformed.
+type SyntaxError struct {
+	Msg string
+	ErrorContext
+}
+
+func (e *SyntaxError) Error() string {
+	return e.Msg
+}
+
+// syntaxErrorf returns a SyntaxError for the form `expr`
+func syntaxErrorf(expr SExpr, format string, args ...interface{}) error {
+	return &SyntaxError{fmt.Sprintf(format, args...), ErrorContext{Expr: expr}}
+}
+
+// RuntimeError is returned when a primitive is used where it is not allowed, such as retry outside of atomically,
+// or when the interpreter itself fails.
+type RuntimeError struct {
+	Msg string
+	ErrorContext
+}
+
+func (e *RuntimeError) Error() string {
+	return e.Msg
+}
+
+func runtimeErrorf(format string, args ...interface{}) error {
+	return &RuntimeError{Msg: fmt.Sprintf(format, args...)}
+}
+
+// UserRaisedError is returned by the `error` primitive.
+type UserRaisedError struct {
+	Message   SExpr
+	Irritants []SExpr
+	ErrorContext
+}
+
+func (e *UserRaisedError) Error() string {
+	parts := []string{e.Message.String()}
+	for _, irritant := range e.Irritants {
+		parts = append(parts, irritant.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// ExitError is returned by the `exit` primitive. It is equivalent to Exit according to errors.Is.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	if e.Code == 0 {
+		return Exit.Error()
+	}
+	return fmt.Sprintf("%v with code %d", Exit, e.Code)
+}
+
+func (e *ExitError) Is(target error) bool {
+	return target == Exit
+}
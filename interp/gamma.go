@@ -1,7 +1,11 @@
 package interp
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"runtime"
+	"sync"
 	"time"
 
 	. "github.com/zfjagann/gamma/sexpr"
@@ -15,6 +19,15 @@ var (
 	ifLiteral     SExpr = Symbol("if")
 	pexecLiteral  SExpr = Symbol("pexec")
 
+	defineMemoizedLiteral SExpr = Symbol("define-memoized")
+
+	// SpecialForms are the names of the forms which the interpreter evaluates without applying a procedure.
+	// They are not bound in any environment.
+	SpecialForms = []string{
+		"lambda", "define", "define-memoized", "cond", "if", "pexec", "select", "receive",
+		"test-equal", "test-assert", "test-error", "check-property",
+	}
+
 	DefaultEnvironment *Environ = MakeEnviron(
 		Symbol("car"), Invariant("car"),
 		Symbol("cdr"), Invariant("cdr"),
@@ -25,39 +38,210 @@ var (
 		Symbol("apply"), Invariant("apply"),
 		Symbol("call/cc"), Invariant("call/cc"),
 		Symbol("exit"), Invariant("exit"),
+		Symbol("error"), Invariant("error"),
+		Symbol("break"), Invariant("break"),
+		Symbol("trace"), Invariant("trace"),
+		Symbol("untrace"), Invariant("untrace"),
+		Symbol("test-begin"), Invariant("test-begin"),
+		Symbol("test-end"), Invariant("test-end"),
+		Symbol("gen-integer"), Invariant("gen-integer"),
+		Symbol("gen-float"), Invariant("gen-float"),
+		Symbol("gen-symbol"), Invariant("gen-symbol"),
+		Symbol("gen-boolean"), Invariant("gen-boolean"),
+		Symbol("gen-list"), Invariant("gen-list"),
+		Symbol("gen-sexpr"), Invariant("gen-sexpr"),
+		Symbol("gen-one-of"), Invariant("gen-one-of"),
+		Symbol("gen-sample"), Invariant("gen-sample"),
 		Symbol("env"), Invariant("env"),
 		Symbol("time"), Invariant("time"),
 		Symbol("sleep"), Invariant("sleep"),
-		Symbol("+"), builtin{"+", Sum},
-		Symbol("-"), builtin{"-", Subtract},
-		Symbol("*"), builtin{"*", Product},
-		Symbol("/"), builtin{"/", Quotient},
+		Symbol("memoize"), Invariant("memoize"),
+		Symbol("pure?"), Invariant("pure?"),
+		Symbol("make-channel"), Invariant("make-channel"),
+		Symbol("channel-send"), Invariant("channel-send"),
+		Symbol("channel-receive"), Invariant("channel-receive"),
+		Symbol("channel-close"), Invariant("channel-close"),
+		Symbol("task-cancel"), Invariant("task-cancel"),
+		Symbol("task-wait"), Invariant("task-wait"),
+		Symbol("task-done?"), Invariant("task-done?"),
+		Symbol("pmap"), Invariant("pmap"),
+		Symbol("pfor-each"), Invariant("pfor-each"),
+		Symbol("pfilter"), Invariant("pfilter"),
+		Symbol("preduce"), Invariant("preduce"),
+		Symbol("make-mutex"), Invariant("make-mutex"),
+		Symbol("with-mutex"), Invariant("with-mutex"),
+		Symbol("make-atomic"), Invariant("make-atomic"),
+		Symbol("atomic-ref"), Invariant("atomic-ref"),
+		Symbol("atomic-swap!"), Invariant("atomic-swap!"),
+		Symbol("compare-and-set!"), Invariant("compare-and-set!"),
+		Symbol("make-tvar"), Invariant("make-tvar"),
+		Symbol("tvar-ref"), Invariant("tvar-ref"),
+		Symbol("tvar-set!"), Invariant("tvar-set!"),
+		Symbol("atomically"), Invariant("atomically"),
+		Symbol("retry"), Invariant("retry"),
+		Symbol("spawn"), Invariant("spawn"),
+		Symbol("spawn-link"), Invariant("spawn-link"),
+		Symbol("link"), Invariant("link"),
+		Symbol("self"), Invariant("self"),
+		Symbol("send"), Invariant("send"),
+		Symbol("make-coroutine"), Invariant("make-coroutine"),
+		Symbol("resume"), Invariant("resume"),
+		Symbol("yield"), Invariant("yield"),
+		Symbol("coroutine-done?"), Invariant("coroutine-done?"),
+		Symbol("make-generator"), Invariant("make-generator"),
+		Symbol("generator-next"), Invariant("generator-next"),
+		Symbol("generator->list"), Invariant("generator->list"),
+		Symbol("spawn-green"), Invariant("spawn-green"),
+		Symbol("thread-yield"), Invariant("thread-yield"),
+		Symbol("+"), arithmetic("+", 0, Sum),
+		Symbol("-"), arithmetic("-", 1, Subtract),
+		Symbol("*"), arithmetic("*", 0, Product),
+		Symbol("/"), arithmetic("/", 1, Quotient),
 		//Symbol("^"), Invariant("^"),
 		//Symbol("%"), Invariant("%"),
 	)
 
+	// Exit is returned when the program calls exit. The error is an *ExitError holding the exit code.
 	Exit error = fmt.Errorf("interpreter exited")
 )
 
+/*
+Type Interpreter evaluates gamma expressions against a global environment.
+
+The global environment is shared by every thread started with `pexec`.
+Because an Environ is never modified once created, a define replaces the global environment
+with a new one while holding `mu`; readers take a snapshot of the environment at the start of evaluation.
+Defines are therefore visible to evaluations which start after the define completes.
+*/
 type Interpreter struct {
+	mu  sync.RWMutex
 	env *Environ
+
+	// maximum number of threads used by the parallel collection primitives
+	workers int
+
+	// the process used by evaluations which were not started by spawn
+	main *Process
+
+	// if not nil, all threads are run by this scheduler
+	sched *scheduler
+
+	limits Limits
+
+	// if not nil, evaluations stop in this debugger
+	debugger *Debugger
+
+	// notified of closure calls
+	tracer Tracer
+	traced *printTracer
+
+	// if not nil, calls and samples are recorded by this profiler
+	profiler *Profiler
+
+	// if not nil, the expressions evaluated are recorded in this coverage report
+	coverage *Coverage
+
+	// records the results of test-equal, test-assert and test-error
+	tests *TestRunner
 }
 
-func NewInterpreter(env *Environ) *Interpreter {
-	return &Interpreter{env}
+// An Option configures an Interpreter.
+type Option func(*Interpreter)
+
+// WithWorkers limits the parallel collection primitives (pmap, pfor-each, pfilter and preduce) to `n` threads.
+// The default is the number of CPUs.
+func WithWorkers(n int) Option {
+	return func(in *Interpreter) {
+		if n < 1 {
+			n = 1
+		}
+		in.workers = n
+	}
+}
+
+func NewInterpreter(env *Environ, opts ...Option) *Interpreter {
+	in := &Interpreter{env: env, workers: runtime.NumCPU(), main: newProcess(), traced: newPrintTracer(os.Stdout), tests: NewTestRunner(os.Stdout)}
+	for _, opt := range opts {
+		opt(in)
+	}
+	return in
 }
 
 func (in *Interpreter) Evaluate(expr SExpr) (SExpr, error) {
-	return in.schemeValue(in.env, newInterpStack(), expr)
+	return in.EvaluateContext(context.Background(), expr)
+}
+
+// EvaluateContext evaluates `expr` like Evaluate, but stops with `ctx.Err()` if `ctx` is cancelled or its deadline passes.
+// The evaluation fails with a FuelExhaustedError or DepthExceededError if it exceeds the limits of the interpreter,
+// or the limits set by ContextWithLimits.
+func (in *Interpreter) EvaluateContext(ctx context.Context, expr SExpr) (SExpr, error) {
+	if b := in.newBudget(ctx); b != nil {
+		ctx = context.WithValue(ctx, budgetKey{}, b)
+	}
+	if in.coverage != nil {
+		in.coverage.Register(expr)
+	}
+	if in.debugger != nil && ctx.Value(debuggerKey{}) == nil {
+		ctx = context.WithValue(ctx, debuggerKey{}, in.debugger)
+	}
+	if in.sched != nil {
+		t := in.sched.enter()
+		defer in.sched.exit(t)
+		ctx = context.WithValue(ctx, threadKey{}, t)
+	}
+	result, err := in.schemeValue(ctx, in.globalEnv(), newInterpStack(), expr)
+	if err != nil {
+		in.traceError(err)
+	}
+	return result, err
+}
+
+/*
+Call applies `proc` to `args` as if by `(proc args...)`, and returns the result.
+
+`proc` may be any procedure: a closure, a built-in, a continuation or a Thunk.
+Applying a continuation continues the evaluation which captured it, and returns the result of that evaluation.
+Call is safe to use from multiple goroutines.
+*/
+func (in *Interpreter) Call(proc SExpr, args ...SExpr) (SExpr, error) {
+	return in.Evaluate(application(proc, List(args...)))
+}
+
+// globalEnv returns a snapshot of the global environment
+func (in *Interpreter) globalEnv() *Environ {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	return in.env
+}
+
+// define binds `sym` to `val` in the global environment
+func (in *Interpreter) define(sym, val SExpr) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.env = in.env.Put(sym, val)
+}
+
+// recursiveClosure returns a copy of `clos` which can refer to itself as `sym`.
+// The original closure is left untouched as it may be shared with other threads.
+func recursiveClosure(clos *Closure, sym, self SExpr) *Closure {
+	rec := NewClosure(clos.SymList, clos.Body, nil)
+	rec.Name = sym
+	if self == nil {
+		self = rec
+	}
+	rec.Env = clos.Env.Put(sym, self)
+	return rec
 }
 
-func (in *Interpreter) schemeValue(env *Environ, stack *interpStack, expr SExpr) (result SExpr, err error) {
+// schemeValue evaluates `expr` within `env`.
+// Evaluation stops with `ctx.Err()` if `ctx` is cancelled.
+func (in *Interpreter) schemeValue(ctx context.Context, env *Environ, stack *interpStack, expr SExpr) (result SExpr, err error) {
 	defer func() {
 		e := recover()
 		if e != nil {
 			fmt.Printf("panic: %v\n%s\n", e, getStack())
 			result = nil
-			err = fmt.Errorf("panic: %v", e)
+			err = runtimeErrorf("panic: %v", e)
 		}
 	}()
 
@@ -66,9 +250,45 @@ func (in *Interpreter) schemeValue(env *Environ, stack *interpStack, expr SExpr)
 		clauses, exprList, C, randList, rator, sym, symList, answer SExpr
 		found                                                       bool
 		answerEnv                                                   *Environ
+		tx                                                          *transaction // the current atomically block
+		held                                                        []*mutexHold // mutexes held by with-mutex blocks
+		thread                                                      = threadFromContext(ctx)
+		budget                                                      = budgetFromContext(ctx)
+		debugger                                                    = debuggerFromContext(ctx)
+		profiler                                                    = in.profiler
+		coverage                                                    = in.coverage
+		primitive                                                   SExpr         // the primitive being run, for the profiler
+		lastTick                                                    int64         // the last tick sampled by the profiler
+		co, current                                                 *Coroutine    // the coroutine to resume, and the running coroutine
+		green                                                       []greenThread // green threads waiting to run
+		site                                                        SExpr         // the application or special form being evaluated
 	)
 
+	defer func() {
+		if err != nil {
+			err = annotate(err, site, stack, C)
+		}
+	}()
+
+	defer func() {
+		// coroutines which are still running when the evaluation ends, because it failed or was abandoned, can never return
+		current.abandon()
+		for _, g := range green {
+			g.current.abandon()
+		}
+	}()
+
+	defer func() {
+		// mutexes are still held if the evaluation failed or escaped from a with-mutex block
+		for _, h := range held {
+			h.release()
+		}
+	}()
+
 	C = CID
+	if profiler != nil {
+		lastTick = profiler.now()
+	}
 
 	// start point
 	goto exprValue
@@ -77,6 +297,17 @@ exprValue:
 	// evaluate the expression `expr` with regard to `env` and call `C` with the result
 	stack.trace("exprValue(expr,env,C)", expr, env, C)
 
+	if IsPair(expr) {
+		site = expr
+	}
+	primitive = nil
+	coverage.mark(expr)
+	if debugger != nil {
+		if err := debugger.step(debugStep{in: in, ctx: ctx, eval: true, expr: expr, env: env, C: C}); err != nil {
+			return nil, err
+		}
+	}
+
 	if IsAtom(expr) {
 		// Atoms are fixed-points of the interpreter
 		answer = expr
@@ -93,52 +324,93 @@ exprValue:
 	} else if IsEq(Car(expr), ifLiteral) {
 		_len := randLength(Cdr(expr))
 		if _len < 3 {
-			return nil, fmt.Errorf("missing parameter from if statement: %v", expr)
+			return nil, syntaxErrorf(expr, "missing parameter from if statement: %v", expr)
 		} else if _len > 3 {
-			return nil, fmt.Errorf("extra parameters from if statement: %v", expr)
+			return nil, syntaxErrorf(expr, "extra parameters from if statement: %v", expr)
 		}
 		_cond, err := ECadr(expr)
 		if err != nil {
-			return nil, fmt.Errorf("CCCC: %v", expr)
+			return nil, syntaxErrorf(expr, "missing condition in if statement: %v", expr)
 		}
 		_exprs, err := ECddr(expr)
 		if err != nil {
-			return nil, fmt.Errorf("AAAA: %v", expr)
+			return nil, syntaxErrorf(expr, "missing branches in if statement: %v", expr)
 		}
+		budget.alloc(allocContinuation, 1)
 		C = NewC9(_exprs, C)
 		expr = _cond
 		goto exprValue
 	} else if IsEq(Car(expr), lambdaLiteral) {
 		argList, err := ECadr(expr)
 		if err != nil {
-			return nil, fmt.Errorf("missing parameter list in function literal: %v", expr)
+			return nil, syntaxErrorf(expr, "missing parameter list in function literal: %v", expr)
 		}
 		body, err := ECaddr(expr)
 		if err != nil {
-			return nil, fmt.Errorf("missing body in function literal: %v", expr)
+			return nil, syntaxErrorf(expr, "missing body in function literal: %v", expr)
 		}
+		budget.alloc(allocClosure, 1)
 		answer = NewClosure(argList, body, env)
 		goto applyC
 	} else if IsEq(Car(expr), defineLiteral) {
 		defSym, err := ECadr(expr)
 		if err != nil {
-			return nil, fmt.Errorf("missing symbol in define: %v", expr)
+			return nil, syntaxErrorf(expr, "missing symbol in define: %v", expr)
 		}
 		defExpr, err := ECaddr(expr)
 		if err != nil {
-			return nil, fmt.Errorf("missing expression in define: %v", expr)
+			return nil, syntaxErrorf(expr, "missing expression in define: %v", expr)
 		}
+		budget.alloc(allocContinuation, 1)
 		C = NewC8(defSym, C)
 		expr = defExpr
 		goto exprValue
+	} else if IsEq(Car(expr), defineMemoizedLiteral) {
+		defSym, err := ECadr(expr)
+		if err != nil {
+			return nil, syntaxErrorf(expr, "missing symbol in define-memoized: %v", expr)
+		}
+		defExpr, err := ECaddr(expr)
+		if err != nil {
+			return nil, syntaxErrorf(expr, "missing expression in define-memoized: %v", expr)
+		}
+		budget.alloc(allocContinuation, 1)
+		C = NewC11(defSym, C)
+		expr = defExpr
+		goto exprValue
 	} else if IsEq(Car(expr), pexecLiteral) {
 		val, err := ECadr(expr)
 		if err != nil {
-			return nil, fmt.Errorf("missing expression in pexec statement: %v", expr)
+			return nil, syntaxErrorf(expr, "missing expression in pexec statement: %v", expr)
 		}
-		answer = in.makePexec(env, val)
+		answer = in.makePexec(ctx, env, val, nil)
 		goto applyC
+	} else if IsEq(Car(expr), selectLiteral) {
+		expr, err = selectApplication(expr)
+		if err != nil {
+			return nil, err
+		}
+		goto exprValue
+	} else if IsEq(Car(expr), receiveLiteral) {
+		expr, err = receiveApplication(expr)
+		if err != nil {
+			return nil, err
+		}
+		goto exprValue
+	} else if IsEq(Car(expr), testEqualLiteral) || IsEq(Car(expr), testAssertLiteral) || IsEq(Car(expr), testErrorLiteral) {
+		expr, err = testApplication(expr)
+		if err != nil {
+			return nil, err
+		}
+		goto exprValue
+	} else if IsEq(Car(expr), checkPropertyLiteral) {
+		expr, err = propertyApplication(expr)
+		if err != nil {
+			return nil, err
+		}
+		goto exprValue
 	} else {
+		budget.alloc(allocContinuation, 1)
 		C = NewC1(expr, env, C)
 		expr = Car(expr)
 		goto exprValue
@@ -152,6 +424,7 @@ exprListValue:
 		answer = Null
 		goto applyC
 	} else {
+		budget.alloc(allocContinuation, 1)
 		C = NewC3(exprList, env, C)
 		expr = Car(exprList)
 		goto exprValue
@@ -163,7 +436,7 @@ symValue:
 
 	answer, found = env.Get(sym)
 	if !found {
-		return nil, fmt.Errorf("environment lookup failed for symbol %q", sym.(Symbol))
+		return nil, &UnboundVariableError{Symbol: sym.(Symbol)}
 	} else {
 		goto applyC
 	}
@@ -174,27 +447,29 @@ condValue:
 
 	if IsNull(clauses) {
 		// (cond)
-		return nil, fmt.Errorf("invalid empty cond block")
+		return nil, syntaxErrorf(nil, "invalid empty cond block")
 	} else if IsNull(Car(clauses)) {
 		// (cond ())
-		return nil, fmt.Errorf("invalid empty cond condition")
+		return nil, syntaxErrorf(nil, "invalid empty cond condition")
 	}
 	{
 		clause := Car(clauses)
 		condition, err := ECar(clause)
 		if err != nil {
 			// (cond ())
-			return nil, fmt.Errorf("missing condition in cond clause: %v", clause)
+			return nil, syntaxErrorf(clause, "missing condition in cond clause: %v", clause)
 		}
 		condExpr, err := ECadr(clause)
 		if err != nil {
 			// (cond (x))
-			return nil, fmt.Errorf("missing expression in cond clause: %v", clause)
+			return nil, syntaxErrorf(clause, "missing expression in cond clause: %v", clause)
 		}
 		if IsEq(condition, elseLiteral) {
+			coverage.mark(clause)
 			expr = condExpr
 			goto exprValue
 		} else {
+			budget.alloc(allocContinuation, 1)
 			C = NewC5(clauses, env, C)
 			expr = condition
 			goto exprValue
@@ -205,11 +480,19 @@ appValue:
 	// apply the operation `rator` with `randList` as arguments and call `C` with the result
 	stack.trace("appValue(rator,randList,C)", rator, randList, C)
 
+	if profiler != nil {
+		profiler.call(rator)
+		if _, ok := rator.(*Closure); !ok {
+			primitive = rator
+		}
+	}
+
 	if bi, ok := rator.(builtin); ok {
-		answer, err = bi.f(answer)
+		answer, err = bi.f(randList)
 		if err != nil {
 			return nil, err
 		}
+		budget.allocValue(answer)
 		goto applyC
 	} else if bi, ok := rator.(Invariant); ok {
 		switch string(bi) {
@@ -217,19 +500,21 @@ appValue:
 			if err := checkLen(1, rator, randList); err != nil {
 				return nil, err
 			}
-			answer, err = ECaar(randList)
-			if err != nil {
-				return nil, err
+			p, ok := Car(randList).(*Pair)
+			if !ok {
+				return nil, &TypeError{Proc: rator, Expected: "a pair", Value: Car(randList)}
 			}
+			answer = p.Car
 			goto applyC
 		case "cdr":
 			if err := checkLen(1, rator, randList); err != nil {
 				return nil, err
 			}
-			answer, err = ECdar(randList)
-			if err != nil {
-				return nil, err
+			p, ok := Car(randList).(*Pair)
+			if !ok {
+				return nil, &TypeError{Proc: rator, Expected: "a pair", Value: Car(randList)}
 			}
+			answer = p.Cdr
 			goto applyC
 		case "cons":
 			if err := checkLen(2, rator, randList); err != nil {
@@ -237,6 +522,7 @@ appValue:
 			}
 			f := Car(randList)
 			s := Cadr(randList)
+			budget.alloc(allocPair, 1)
 			answer = Cons(f, s)
 			goto applyC
 		case "eq?":
@@ -275,10 +561,80 @@ appValue:
 			answer = env
 			goto applyC
 		case "exit":
+			if IsNull(randList) {
+				return nil, &ExitError{0}
+			}
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			code, ok := Car(randList).(Integer)
+			if !ok {
+				return nil, &TypeError{Proc: rator, Expected: "an integer exit code", Value: Car(randList)}
+			}
+			return nil, &ExitError{int(code)}
+		case "break":
 			if err := checkLen(0, rator, randList); err != nil {
 				return nil, err
 			}
-			return nil, Exit
+			if debugger != nil {
+				debugger.breakNow()
+			}
+			answer = Null
+			goto applyC
+		case "trace", "untrace":
+			closures, err := tracedClosures(rator, randList)
+			if err != nil {
+				return nil, err
+			}
+			in.traced.trace(closures, bi == "trace")
+			answer = Null
+			goto applyC
+		case "test-begin":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			in.tests.begin(Car(randList))
+			answer = Null
+			goto applyC
+		case "test-end":
+			if err := in.tests.end(rator, randList); err != nil {
+				return nil, err
+			}
+			answer = Null
+			goto applyC
+		case "test-equal", "test-assert", "test-error":
+			// rewritten by testApplication
+			if err := in.runTest(ctx, stack, string(bi), randList); err != nil {
+				return nil, err
+			}
+			answer = Null
+			goto applyC
+		case "check-property":
+			// rewritten by propertyApplication
+			if err := in.checkProperty(ctx, stack, randList); err != nil {
+				return nil, err
+			}
+			answer = Null
+			goto applyC
+		case "gen-integer", "gen-float", "gen-symbol", "gen-boolean", "gen-list", "gen-sexpr", "gen-one-of":
+			answer, err = makeGen(string(bi), rator, randList)
+			if err != nil {
+				return nil, err
+			}
+			goto applyC
+		case "gen-sample":
+			answer, err = genSample(rator, randList)
+			if err != nil {
+				return nil, err
+			}
+			budget.allocValue(answer)
+			goto applyC
+		case "error":
+			if IsNull(randList) {
+				return nil, &ArityError{Proc: rator, Expected: 1, Variadic: true}
+			}
+			irritants, _ := listToSlice(rator, Cdr(randList))
+			return nil, &UserRaisedError{Message: Car(randList), Irritants: irritants}
 		case "call/cc":
 			if err := checkLen(1, rator, randList); err != nil {
 				return nil, err
@@ -298,20 +654,466 @@ appValue:
 			}
 			f := Car(randList)
 			if t, ok := f.(Integer); ok {
-				time.Sleep(time.Duration(t) * time.Second)
+				if _, _, _, err := in.selectCases(ctx, nil, time.Duration(t)*time.Second); err != nil {
+					return nil, err
+				}
 			} else {
-				return nil, fmt.Errorf("Invalid time value: %v", f)
+				return nil, &TypeError{Proc: rator, Expected: "a number of seconds", Value: f}
 			}
 			answer = Integer(time.Now().UnixNano() / 1000000)
 			goto applyC
+		case "memoize":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			clos, ok := Car(randList).(*Closure)
+			if !ok {
+				return nil, &TypeError{Proc: Symbol("memoize"), Expected: "a closure", Value: Car(randList)}
+			}
+			if !isPure(clos) {
+				return nil, runtimeErrorf("cannot memoize impure closure: %v", clos)
+			}
+			answer = newMemoized(clos)
+			goto applyC
+		case "pure?":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			switch f := Car(randList).(type) {
+			case *Closure:
+				answer = Boolean(isPure(f))
+			case *Memoized:
+				answer = True
+			default:
+				answer = Boolean(pureValue(f, nil))
+			}
+			goto applyC
+		case "make-channel":
+			size := 0
+			if !IsNull(randList) {
+				if err := checkLen(1, rator, randList); err != nil {
+					return nil, err
+				}
+				n, ok := Car(randList).(Integer)
+				if !ok || n < 0 {
+					return nil, &TypeError{Proc: rator, Expected: "a non-negative integer", Value: Car(randList)}
+				}
+				size = int(n)
+			}
+			if err := budget.reserve(allocSlot, size); err != nil {
+				return nil, err
+			}
+			answer = NewChannel(size)
+			goto applyC
+		case "channel-send":
+			if err := checkLen(2, rator, randList); err != nil {
+				return nil, err
+			}
+			ch, err := toChannel(rator, Car(randList))
+			if err != nil {
+				return nil, err
+			}
+			if err := in.channelSend(ctx, ch, Cadr(randList)); err != nil {
+				return nil, err
+			}
+			answer = Null
+			goto applyC
+		case "channel-receive":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			ch, err := toChannel(rator, Car(randList))
+			if err != nil {
+				return nil, err
+			}
+			answer, err = in.channelReceive(ctx, ch)
+			if err != nil {
+				return nil, err
+			}
+			goto applyC
+		case "channel-close":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			ch, err := toChannel(rator, Car(randList))
+			if err != nil {
+				return nil, err
+			}
+			if err := ch.Close(); err != nil {
+				return nil, err
+			}
+			answer = Null
+			goto applyC
+		case "select":
+			rator, randList, err = in.selectChannel(ctx, randList)
+			if err != nil {
+				return nil, err
+			}
+			goto appValue
+		case "task-cancel":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			p, err := toPexec(rator, Car(randList))
+			if err != nil {
+				return nil, err
+			}
+			p.Cancel()
+			answer = Null
+			goto applyC
+		case "task-wait":
+			if err := checkLen(2, rator, randList); err != nil {
+				return nil, err
+			}
+			p, err := toPexec(rator, Car(randList))
+			if err != nil {
+				return nil, err
+			}
+			t, ok := Cadr(randList).(Integer)
+			if !ok {
+				return nil, &TypeError{Proc: rator, Expected: "a number of milliseconds", Value: Cadr(randList)}
+			}
+			result, done, err := in.waitPexec(ctx, p, time.Duration(t)*time.Millisecond)
+			if err != nil {
+				return nil, err
+			} else if !done {
+				answer = False
+			} else {
+				answer = result
+			}
+			goto applyC
+		case "task-done?":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			p, err := toPexec(rator, Car(randList))
+			if err != nil {
+				return nil, err
+			}
+			select {
+			case <-p.Done():
+				answer = True
+			default:
+				answer = False
+			}
+			goto applyC
+		case "pmap", "pfor-each", "pfilter":
+			if err := checkLen(2, rator, randList); err != nil {
+				return nil, err
+			}
+			items, err := listToSlice(rator, Cadr(randList))
+			if err != nil {
+				return nil, err
+			}
+			var results []SExpr
+			if string(bi) == "pfilter" {
+				results, err = in.pfilter(ctx, Car(randList), items)
+			} else {
+				results, err = in.pmap(ctx, Car(randList), items)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if string(bi) == "pfor-each" {
+				answer = Null
+			} else {
+				budget.alloc(allocPair, len(results))
+				answer = List(results...)
+			}
+			goto applyC
+		case "preduce":
+			if err := checkLen(3, rator, randList); err != nil {
+				return nil, err
+			}
+			items, err := listToSlice(rator, Caddr(randList))
+			if err != nil {
+				return nil, err
+			}
+			answer, err = in.preduce(ctx, Car(randList), Cadr(randList), items)
+			if err != nil {
+				return nil, err
+			}
+			goto applyC
+		case "make-mutex":
+			if err := checkLen(0, rator, randList); err != nil {
+				return nil, err
+			}
+			answer = newMutex()
+			goto applyC
+		case "with-mutex":
+			if err := checkLen(2, rator, randList); err != nil {
+				return nil, err
+			}
+			m, err := toMutex(rator, Car(randList))
+			if err != nil {
+				return nil, err
+			}
+			if err := in.lockMutex(ctx, m); err != nil {
+				return nil, err
+			}
+			hold := &mutexHold{m: m}
+			held = append(held, hold)
+			budget.alloc(allocContinuation, 1)
+			C = NewC12(hold, C)
+			hold.depth = depthOf(C)
+			rator = Cadr(randList)
+			randList = Null
+			goto appValue
+		case "make-atomic":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			answer = &Atomic{value: Car(randList)}
+			goto applyC
+		case "atomic-ref":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			box, err := toAtomic(rator, Car(randList))
+			if err != nil {
+				return nil, err
+			}
+			answer = box.get()
+			goto applyC
+		case "atomic-swap!":
+			if err := checkLen(2, rator, randList); err != nil {
+				return nil, err
+			}
+			box, err := toAtomic(rator, Car(randList))
+			if err != nil {
+				return nil, err
+			}
+			rator = Cadr(randList)
+			randList = List(box.get())
+			budget.alloc(allocContinuation, 1)
+			C = NewC13(box, rator, randList, C)
+			goto appValue
+		case "compare-and-set!":
+			if err := checkLen(3, rator, randList); err != nil {
+				return nil, err
+			}
+			box, err := toAtomic(rator, Car(randList))
+			if err != nil {
+				return nil, err
+			}
+			answer = Boolean(box.compareAndSet(Cadr(randList), Caddr(randList)))
+			goto applyC
+		case "make-tvar":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			answer = &TVar{value: Car(randList)}
+			goto applyC
+		case "tvar-ref":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			tv, err := toTVar(rator, Car(randList))
+			if err != nil {
+				return nil, err
+			}
+			if tx != nil {
+				answer = tx.read(tv)
+			} else {
+				answer = readTVar(tv)
+			}
+			goto applyC
+		case "tvar-set!":
+			if err := checkLen(2, rator, randList); err != nil {
+				return nil, err
+			}
+			tv, err := toTVar(rator, Car(randList))
+			if err != nil {
+				return nil, err
+			}
+			if tx == nil {
+				return nil, runtimeErrorf("tvar-set! outside of atomically")
+			}
+			tx.write(tv, Cadr(randList))
+			answer = Null
+			goto applyC
+		case "atomically":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			rator = Car(randList)
+			randList = Null
+			if tx == nil {
+				tx = newTransaction(rator, C)
+				budget.alloc(allocContinuation, 1)
+				C = NewC14(C)
+			}
+			// nested atomically blocks are part of the enclosing transaction
+			goto appValue
+		case "retry":
+			if err := checkLen(0, rator, randList); err != nil {
+				return nil, err
+			}
+			if tx == nil {
+				return nil, runtimeErrorf("retry outside of atomically")
+			}
+			if err := in.waitTransaction(ctx, tx); err != nil {
+				return nil, err
+			}
+			tx = newTransaction(tx.thunk, tx.C)
+			budget.alloc(allocContinuation, 1)
+			C = NewC14(tx.C)
+			rator = tx.thunk
+			randList = Null
+			goto appValue
+		case "spawn", "spawn-link":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			answer = in.spawn(ctx, Car(randList), string(bi) == "spawn-link")
+			goto applyC
+		case "link":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			p, err := toProcess(rator, Car(randList))
+			if err != nil {
+				return nil, err
+			}
+			p.link(in.currentProcess(ctx))
+			answer = Null
+			goto applyC
+		case "self":
+			if err := checkLen(0, rator, randList); err != nil {
+				return nil, err
+			}
+			answer = in.currentProcess(ctx)
+			goto applyC
+		case "send":
+			if err := checkLen(2, rator, randList); err != nil {
+				return nil, err
+			}
+			p, err := toProcess(rator, Car(randList))
+			if err != nil {
+				return nil, err
+			}
+			p.deliver(Cadr(randList), budget)
+			answer = Null
+			goto applyC
+		case "receive":
+			rator, randList, err = in.receiveMessage(ctx, randList)
+			if err != nil {
+				return nil, err
+			}
+			goto appValue
+		case "make-coroutine", "make-generator":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			answer = &Coroutine{proc: Car(randList), generator: string(bi) == "make-generator"}
+			goto applyC
+		case "resume":
+			if err := checkLen(2, rator, randList); err != nil {
+				return nil, err
+			}
+			co, err = toCoroutine(rator, Car(randList))
+			if err != nil {
+				return nil, err
+			}
+			answer = Cadr(randList)
+			goto resumeValue
+		case "generator-next":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			co, err = toCoroutine(rator, Car(randList))
+			if err != nil {
+				return nil, err
+			}
+			answer = Null
+			goto resumeValue
+		case "yield":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			if current == nil {
+				return nil, runtimeErrorf("yield outside of a coroutine")
+			}
+			C, current = current.suspend(C)
+			answer = Car(randList)
+			goto applyC
+		case "coroutine-done?":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			co, err := toCoroutine(rator, Car(randList))
+			if err != nil {
+				return nil, err
+			}
+			answer = Boolean(co.done())
+			goto applyC
+		case "generator->list":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			co, err = toCoroutine(rator, Car(randList))
+			if err != nil {
+				return nil, err
+			}
+			if co.done() {
+				answer = Null
+				goto applyC
+			}
+			budget.alloc(allocContinuation, 1)
+			C = NewC16(co, Null, C)
+			answer = Null
+			goto resumeValue
+		case "spawn-green":
+			if err := checkLen(1, rator, randList); err != nil {
+				return nil, err
+			}
+			green = append(green, greenThread{thunk: Car(randList)})
+			answer = Null
+			goto applyC
+		case "thread-yield":
+			if err := checkLen(0, rator, randList); err != nil {
+				return nil, err
+			}
+			answer = Null
+			if len(green) == 0 {
+				goto applyC
+			}
+			green = append(green, greenThread{C: C, current: current})
+			next := green[0]
+			green = green[1:]
+			current = next.current
+			if next.thunk != nil {
+				C = C17
+				rator = next.thunk
+				randList = Null
+				goto appValue
+			}
+			C = next.C
+			goto applyC
 		default:
-			return nil, fmt.Errorf("unknown built-in method: %q", string(bi))
+			return nil, &TypeError{Expected: "a procedure", Value: rator}
 		}
 	} else if clos, ok := rator.(*Closure); ok {
-		C = NewC6(clos, C)
+		budget.alloc(allocContinuation, 1)
+		C = NewC6(clos, site, randList, C)
 		symList = clos.SymList
 		env = clos.Env
 		goto augmentedEnv
+	} else if memo, ok := rator.(*Memoized); ok {
+		if cached, found := memo.lookup(randList); found {
+			answer = cached
+			goto applyC
+		}
+		budget.alloc(allocContinuation, 1)
+		C = NewC10(memo, randList, C)
+		rator = memo.Closure
+		goto appValue
+	} else if p, ok := rator.(*Pexec); ok {
+		answer, _, err = in.waitPexec(ctx, p, -1)
+		if err != nil {
+			return nil, err
+		}
+		goto applyC
 	} else if thunk, ok := rator.(Thunk); ok {
 		answer, err = thunk.GetResult()
 		if err != nil {
@@ -321,9 +1123,19 @@ appValue:
 	} else if cont, ok := rator.(Continuation); ok {
 		C = cont.C
 		answer = Car(randList)
+		// escaping from a with-mutex block releases the mutex, and escaping from an atomically block abandons the transaction
+		for i := len(held) - 1; i >= 0; i-- {
+			if !held[i].within(C) {
+				held[i].release()
+				held = append(held[:i], held[i+1:]...)
+			}
+		}
+		if tx != nil && !tx.within(C) {
+			tx = nil
+		}
 		goto applyC
 	} else {
-		return nil, fmt.Errorf("Unknown operator: %v", rator)
+		return nil, &TypeError{Expected: "a procedure", Value: rator}
 	}
 
 augmentedEnv:
@@ -335,6 +1147,7 @@ augmentedEnv:
 		if IsNull(symList) {
 			goto applyC
 		} else if IsSymbol(symList) {
+			budget.alloc(allocPair, 2)
 			answerEnv = answerEnv.Put(symList, randList)
 			symList = Null
 			randList = Null
@@ -342,18 +1155,62 @@ augmentedEnv:
 			if err := checkLen(randLength(symList), rator, randList); err != nil {
 				return nil, err
 			}
+			budget.alloc(allocPair, 2)
 			answerEnv = answerEnv.Put(Car(symList), Car(randList))
 			symList = Cdr(symList)
 			randList = Cdr(randList)
 		}
 	}
 
+resumeValue:
+	// resume the coroutine `co` with the value `answer` and call `C` with the value it yields
+	stack.trace("resumeValue(co,answer,C)", co, answer, C)
+
+	if state, saved, err := co.resume(C, current); err != nil {
+		return nil, err
+	} else if state == coroutineSuspended {
+		current = co
+		C = saved
+		goto applyC
+	}
+	current = co
+	budget.alloc(allocContinuation, 1)
+	C = NewC15(co)
+	rator = co.proc
+	if co.generator {
+		randList = Null
+	} else {
+		randList = List(answer)
+	}
+	goto appValue
+
 applyC:
 	// apply the continuation `C` to the value `answer`
 	// the continuation values defined below are a result of continuation function literals
 	// in the original scheme interpreter that have been translated to Go
 	stack.trace("applyC(answer,C)", answer, C)
 
+	if err := ctx.Err(); err != nil {
+		// the evaluation has been cancelled
+		return nil, err
+	}
+	if err := budget.step(C); err != nil {
+		return nil, err
+	}
+	if profiler != nil {
+		profiler.sample(&lastTick, primitive, C)
+		primitive = nil
+	}
+	if debugger != nil {
+		if err := debugger.step(debugStep{in: in, ctx: ctx, answer: answer, env: env, C: C}); err != nil {
+			return nil, err
+		}
+	}
+	if thread != nil {
+		// give other threads a chance to run
+		in.sched.yield(thread)
+	}
+
 	if C == CID {
 		// the program has finished computing
 		return answer, nil
@@ -365,7 +1222,8 @@ applyC:
 			// C1 evaluates the parameter list, then calls C2 which calls performs the function call
 			exprList = Cdr(c.Expr)
 			env = c.Env
-			C = NewC2(answer, c.Env, c.C)
+			budget.alloc(allocContinuation, 1)
+			C = NewC2(answer, c.Expr, c.Env, c.C)
 			goto exprListValue
 		case "c2":
 			// C2 is the continuation from a function application called after the rator and randList have been evaluated
@@ -373,23 +1231,27 @@ applyC:
 			rator = c.Answer
 			randList = answer
 			env = c.Env
+			site = c.Expr
 			C = c.C
 			goto appValue
 		case "c3":
 			// C3 is the continuation from the recursive case of exprListValue which performs the tail recursion
 			exprList = Cdr(c.ExprList)
 			env = c.Env
+			budget.alloc(allocContinuation, 1)
 			C = NewC4(answer, c.C)
 			goto exprListValue
 		case "c4":
 			// C4 is the continuation from the recursive case of exprListValue which performs the
 			// cons on the result of the previous two computations
+			budget.alloc(allocPair, 1)
 			answer = Cons(c.Answer, answer)
 			C = c.C
 			goto applyC
 		case "c5":
 			// C5 is the continuation from the recursive case of condValue
 			if !IsEq(answer, False) {
+				coverage.mark(Car(c.Clauses))
 				expr = Cadar(c.Clauses)
 				env = c.Env
 				C = c.C
@@ -405,30 +1267,144 @@ applyC:
 			expr = c.Rator.Body
 			env = answerEnv
 			C = c.C
+			if caller, ok := C.(interpContinuation); ok && caller.id == "c18" {
+				// a tail call replaces the frame of its caller
+				C = caller.C
+			}
+			budget.alloc(allocContinuation, 1)
+			frame := &Frame{Proc: c.Rator, Args: c.RandList, Pos: PosOf(c.Expr), Depth: callDepth(C)}
+			C = NewC18(frame, C)
+			in.traceEnter(frame)
 			goto exprValue
 		case "c8":
 			// C8 is called during a define block with the evaluated expression
 			if clos, ok := answer.(*Closure); ok {
 				// Cheap hack to make recursive functions work
-				clos.Env = clos.Env.Put(c.Symbol, clos)
+				budget.alloc(allocClosure, 1)
+				answer = recursiveClosure(clos, c.Symbol, nil)
 			}
-			in.env = in.env.Put(c.Symbol, answer)
+			in.define(c.Symbol, answer)
 			answer = Null
 			C = c.C
 			goto applyC
 		case "c9":
 			// C9 is called during an if with the evaluated condition
 			if IsEq(answer, False) {
+				coverage.mark(Cdr(c.ExprList))
 				expr = Cadr(c.ExprList)
 			} else {
+				coverage.mark(c.ExprList)
 				expr = Car(c.ExprList)
 			}
 			C = c.C
 			goto exprValue
+		case "c10":
+			// C10 is called with the result of a memoized closure
+			c.Answer.(*Memoized).store(c.RandList, answer)
+			C = c.C
+			goto applyC
+		case "c11":
+			// C11 is called during a define-memoized block with the evaluated expression
+			clos, ok := answer.(*Closure)
+			if !ok {
+				return nil, &TypeError{Proc: Symbol("define-memoized"), Expected: "a closure", Value: answer}
+			}
+			memo := newMemoized(nil)
+			// Recursive calls should go through the cache
+			budget.alloc(allocClosure, 1)
+			memo.Closure = recursiveClosure(clos, c.Symbol, memo)
+			if !isPure(memo.Closure) {
+				return nil, runtimeErrorf("cannot memoize impure closure: %v", clos)
+			}
+			in.define(c.Symbol, memo)
+			answer = Null
+			C = c.C
+			goto applyC
+		case "c12":
+			// C12 is called after the thunk in a with-mutex block to release the mutex
+			hold := c.Answer.(*mutexHold)
+			for i := len(held) - 1; i >= 0; i-- {
+				if held[i] == hold {
+					held = append(held[:i], held[i+1:]...)
+					break
+				}
+			}
+			hold.release()
+			C = c.C
+			goto applyC
+		case "c13":
+			// C13 is called during an atomic-swap! with the new value of the atomic
+			box := c.Answer.(*Atomic)
+			if box.compareAndSet(Car(c.RandList), answer) {
+				C = c.C
+				goto applyC
+			}
+			// another thread changed the value first, try again
+			rator = c.Expr
+			randList = List(box.get())
+			budget.alloc(allocContinuation, 1)
+			C = NewC13(box, rator, randList, c.C)
+			goto appValue
+		case "c14":
+			// C14 is called at the end of an atomically block to commit the transaction
+			if tx == nil || tx.commit() {
+				tx = nil
+				C = c.C
+				goto applyC
+			}
+			// another transaction modified a tvar we read, try again
+			tx = newTransaction(tx.thunk, tx.C)
+			budget.alloc(allocContinuation, 1)
+			C = NewC14(tx.C)
+			rator = tx.thunk
+			randList = Null
+			goto appValue
+		case "c15":
+			// C15 is called when a coroutine returns
+			C, current = c.Answer.(*Coroutine).finish()
+			goto applyC
+		case "c16":
+			// C16 is called during generator->list with the next value of the generator
+			co = c.Answer.(*Coroutine)
+			if co.done() {
+				// the generator returned instead of yielding
+				budget.alloc(allocPair, randLength(c.ExprList))
+				answer = reverse(c.ExprList)
+				C = c.C
+				goto applyC
+			}
+			budget.alloc(allocContinuation, 1)
+			budget.alloc(allocPair, 1)
+			C = NewC16(co, Cons(answer, c.ExprList), c.C)
+			answer = Null
+			goto resumeValue
+		case "c18":
+			// C18 marks the evaluation of the body of a closure
+			in.traceReturn(c.Answer.(*Frame), answer)
+			C = c.C
+			goto applyC
+		case "c17":
+			// C17 is called when a green thread finishes
+			if len(green) == 0 {
+				C = CID
+				goto applyC
+			}
+			next := green[0]
+			green = green[1:]
+			current = next.current
+			if next.thunk != nil {
+				C = C17
+				rator = next.thunk
+				randList = Null
+				goto appValue
+			}
+			answer = Null
+			C = next.C
+			goto applyC
 		default:
-			return nil, fmt.Errorf("invalid continuation value: %v", C)
+			return nil, runtimeErrorf("invalid continuation value: %v", C)
 		}
 	} else {
-		return nil, fmt.Errorf("invalid continuation value: %v", C)
+		return nil, runtimeErrorf("invalid continuation value: %v", C)
 	}
 }
@@ -1,10 +1,21 @@
 package interp
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/zfjagann/gamma/parse"
 	. "github.com/zfjagann/gamma/sexpr"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const TestTraceSize = 500 // How many stack records to show on failure
@@ -116,6 +127,219 @@ var testCases = []testCase{
 	pass(
 		mustParse("((pexec 'a))"),
 		Symbol("a")),
+	pass(
+		mustParse("((memoize (lambda (x) (+ x 1))) 2)"),
+		Integer(3)),
+	pass(
+		mustParse("(pure? (lambda (x) (+ x 1)))"),
+		True),
+	pass(
+		mustParse("(pure? (lambda (x) (sleep x)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (sleep) (sleep 1)))"),
+		True),
+	pass(
+		mustParse("((lambda (c) (cdr (cons (channel-send c 'a) (channel-receive c)))) (make-channel 1))"),
+		Symbol("a")),
+	pass(
+		mustParse("((lambda (c) (cdr (cons (pexec (channel-send c 'a)) (channel-receive c)))) (make-channel))"),
+		Symbol("a")),
+	pass(
+		mustParse("((lambda (c) (cdr (cons (channel-close c) (channel-receive c)))) (make-channel))"),
+		Null),
+	pass(
+		mustParse("((lambda (c) (cdr (cons (channel-send c 'a) (select (c x (cons x 'b)) (after 1000 'timeout))))) (make-channel 1))"),
+		Cons(Symbol("a"), Symbol("b"))),
+	pass(
+		mustParse("((lambda (c) (select (c x x) (after 10 'timeout))) (make-channel))"),
+		Symbol("timeout")),
+	fail(
+		mustParse("((lambda (c) (select (10 x x) (c y y))) (make-channel))"),
+		"select expects a channel but was given 10"),
+	fail(
+		mustParse("(select (after 'soon 'timeout))"),
+		"select expects a number of milliseconds but was given soon"),
+	pass(
+		mustParse("(pure? (lambda (c) (channel-receive c)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (c) (select (c x x))))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (x) (pexec x)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (x) (begin (trace x) x)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (x) (begin (break) x)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (x) (test-equal x 1)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (x) (check-property (lambda (n) #t) (gen-integer))))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda () (test-end)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (f) (spawn f)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (f) (spawn-link f)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (p) (link p)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda () (self)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (p) (send p 'a)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda () (receive (x x))))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (t) (task-wait t 10)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (t) (task-cancel t)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda () (make-mutex)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (m) (with-mutex m (lambda () 'a))))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda () (make-atomic 'a)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (a) (atomic-ref a)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (a) (atomic-swap! a 1)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (a) (compare-and-set! a 1 2)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda () (make-tvar 'a)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (tv) (tvar-ref tv)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (tv) (tvar-set! tv 1)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (f) (atomically f)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda () (retry)))"),
+		False),
+	pass(
+		mustParse("(pmap (lambda (x) (+ x 1)) '(1 2 3 4 5))"),
+		List(Integer(2), Integer(3), Integer(4), Integer(5), Integer(6))),
+	pass(
+		mustParse("(pmap car '())"),
+		Null),
+	pass(
+		mustParse("(pfilter (lambda (x) (eq? x 'a)) '(a b a c))"),
+		List(Symbol("a"), Symbol("a"))),
+	pass(
+		mustParse("(pfor-each (lambda (x) x) '(a b))"),
+		Null),
+	pass(
+		mustParse("(preduce + 0 '(1 2 3 4 5 6 7 8 9 10))"),
+		Integer(55)),
+	pass(
+		mustParse("(preduce cons '() '())"),
+		Null),
+	pass(
+		mustParse("(with-mutex (make-mutex) (lambda () 'a))"),
+		Symbol("a")),
+	pass(
+		mustParse("((lambda (a) (cons (compare-and-set! a 1 2) (compare-and-set! a 1 3))) (make-atomic 1))"),
+		Cons(True, False)),
+	pass(
+		mustParse("((lambda (a) (cdr (cons (pfor-each (lambda (x) (atomic-swap! a (lambda (n) (+ n x)))) '(1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 19 20)) (atomic-ref a)))) (make-atomic 0))"),
+		Integer(210)),
+	pass(
+		mustParse("((lambda (tv) (cdr (cons (pfor-each (lambda (x) (atomically (lambda () (tvar-set! tv (+ x (tvar-ref tv)))))) '(1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 19 20)) (tvar-ref tv)))) (make-tvar 0))"),
+		Integer(210)),
+	pass(
+		mustParse("((lambda (tv) (cdr (cons (pexec (atomically (lambda () (tvar-set! tv 'ready)))) (atomically (lambda () (cond ((null? (tvar-ref tv)) (retry)) (else (tvar-ref tv)))))))) (make-tvar '()))"),
+		Symbol("ready")),
+	pass(
+		mustParse("((lambda (p) (cdr (cons (send p 'hi) (receive (x x))))) (self))"),
+		Symbol("hi")),
+	pass(
+		mustParse("((lambda (p) (cdr (cons (send p '(a 1)) (receive (('b x) x) (('a x) x))))) (self))"),
+		Integer(1)),
+	pass(
+		mustParse("(receive (x x) (after 10 'timeout))"),
+		Symbol("timeout")),
+	pass(
+		mustParse("((lambda (me) ((lambda (p) (cdr (cons (send p (cons me 'ping)) (receive (('pong) 'got-pong) (after 1000 'timeout))))) (spawn (lambda () (receive ((from . msg) (send from '(pong)))))))) (self))"),
+		Symbol("got-pong")),
+	pass(
+		mustParse("((lambda (p) (receive (('exit pid reason) (symbol? reason)) (after 1000 'timeout))) (spawn-link (lambda () (car 'a))))"),
+		False),
+	pass(
+		mustParse("((lambda (co) (cons (resume co 1) (resume co 2))) (make-coroutine (lambda (x) (+ (yield x) 10))))"),
+		Cons(Integer(1), Integer(12))),
+	pass(
+		mustParse("((lambda (co) (cons (resume co 1) (coroutine-done? co))) (make-coroutine (lambda (x) x)))"),
+		Cons(Integer(1), True)),
+	pass(
+		mustParse("(generator->list (make-generator (lambda () (cdr (cons (yield 'a) (cons (yield 'b) (yield 'c)))))))"),
+		List(Symbol("a"), Symbol("b"), Symbol("c"))),
+	pass(
+		mustParse("((lambda (g) (cons (generator-next g) (generator-next g))) (make-generator (lambda () (cdr (cons (yield 'a) (yield 'b))))))"),
+		Cons(Symbol("a"), Symbol("b"))),
+	pass(
+		mustParse("((lambda (list c) (list (spawn-green (lambda () (channel-send c 'g))) (channel-send c 'm1) (thread-yield) (channel-send c 'm2) (channel-receive c) (channel-receive c) (channel-receive c))) (lambda x x) (make-channel 3))"),
+		List(Null, Null, Null, Null, Symbol("m1"), Symbol("g"), Symbol("m2"))),
+	pass(
+		mustParse("(pure? (lambda (f) (make-coroutine f)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (f) (make-generator f)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (co) (resume co 'a)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (g) (generator-next g)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (x) (yield x)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (co) (coroutine-done? co)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (g) (generator->list g)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda (f) (spawn-green f)))"),
+		False),
+	pass(
+		mustParse("(pure? (lambda () (thread-yield)))"),
+		False),
+	pass(
+		mustParse("((lambda (t) (task-wait t 1000)) (pexec 'a))"),
+		Symbol("a")),
+	pass(
+		mustParse("((lambda (t) (cdr (cons (task-wait t 1000) (task-done? t)))) (pexec 'a))"),
+		True),
+	pass(
+		mustParse("((lambda (t) (car (cons (task-wait t 10) (task-cancel t)))) (pexec (sleep 1)))"),
+		False),
 
 	/**
 	*** Negative Test Cases
@@ -180,6 +404,60 @@ var testCases = []testCase{
 	fail(
 		mustParse("((lambda (x) 'a))"),
 		`<closure> expects 1 arguments but was given 0`),
+	fail(
+		mustParse("(memoize (lambda () (time)))"),
+		`cannot memoize impure closure: <closure>`),
+	fail(
+		mustParse("(memoize 'a)"),
+		`memoize expects a closure but was given a`),
+	fail(
+		mustParse("(define-memoized a 'b)"),
+		`define-memoized expects a closure but was given b`),
+	fail(
+		mustParse("(channel-send 'a 'b)"),
+		`<built-in channel-send> expects a channel but was given a`),
+	fail(
+		mustParse("((lambda (c) (cdr (cons (channel-close c) (channel-send c 'a)))) (make-channel))"),
+		`send on closed channel`),
+	fail(
+		mustParse("((lambda (t) (cdr (cons (task-cancel t) (t)))) (pexec (sleep 10)))"),
+		`context canceled`),
+	fail(
+		mustParse("((lambda (t) (cdr (cons (task-cancel t) (t)))) (pexec ((lambda (x) (x x)) (lambda (x) (x x)))))"),
+		`context canceled`),
+	fail(
+		mustParse("(pmap car '(a))"),
+		`<built-in car> expects a pair but was given a`),
+	fail(
+		mustParse("(pmap car 'a)"),
+		`<built-in pmap> expects a list but was given a`),
+	fail(
+		mustParse("(tvar-set! (make-tvar 1) 2)"),
+		`tvar-set! outside of atomically`),
+	fail(
+		mustParse("(retry)"),
+		`retry outside of atomically`),
+	fail(
+		mustParse("(send 'a 'b)"),
+		`<built-in send> expects a process but was given a`),
+	fail(
+		mustParse("(receive (a b c))"),
+		`invalid receive clause: (a b c)`),
+	fail(
+		mustParse("(yield 'a)"),
+		`yield outside of a coroutine`),
+	fail(
+		mustParse("((lambda (co) (cons (resume co 1) (resume co 2))) (make-coroutine (lambda (x) x)))"),
+		`resume of dead coroutine`),
+	fail(
+		mustParse("(task-wait 'a 1)"),
+		`<built-in task-wait> expects a pexec but was given a`),
+	fail(
+		mustParse("(select)"),
+		`invalid empty select block`),
+	fail(
+		mustParse("(select (a b))"),
+		`invalid select clause: (a b)`),
 	fail(
 		mustParse("(if)"),
 		`missing parameter from if statement: (if)`),
@@ -206,6 +484,764 @@ func TestDefinesRecursiveFunction(t *testing.T) {
 	assertEvaluates(t, interp, "(len '(a b c d))", Integer(4))
 }
 
+func TestDefinesMemoizedFunction(t *testing.T) {
+	interp := NewInterpreter(DefaultEnvironment)
+	// Without memoization this takes exponential time.
+	assertEvaluates(t, interp, "(define-memoized fib (lambda (n) (cond ((eq? n 0) 0) ((eq? n 1) 1) (else (+ (fib (- n 1)) (fib (- n 2)))))))", nil)
+	assertEvaluates(t, interp, "(fib 60)", Integer(1548008755920))
+}
+
+func TestConcurrentDefine(t *testing.T) {
+	interp := NewInterpreter(DefaultEnvironment)
+	assertEvaluates(t, interp, "(define a 'x)", nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := interp.Evaluate(mustParse("((pexec (define b (lambda () a))))")); err != nil {
+					t.Error(err)
+				}
+				if _, err := interp.Evaluate(mustParse("(b)")); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assertEvaluates(t, interp, "(b)", Symbol("x"))
+}
+
+func TestParallelWorkers(t *testing.T) {
+	interp := NewInterpreter(DefaultEnvironment, WithWorkers(2))
+	assertEvaluates(t, interp, "(pmap (lambda (x) (* x x)) '(1 2 3 4 5))", List(Integer(1), Integer(4), Integer(9), Integer(16), Integer(25)))
+	assertEvaluates(t, interp, "(preduce * 1 '(1 2 3 4 5))", Integer(120))
+}
+
+func TestMutexReleasedOnError(t *testing.T) {
+	interp := NewInterpreter(DefaultEnvironment)
+	assertEvaluates(t, interp, "(define m (make-mutex))", nil)
+	if _, err := interp.Evaluate(mustParse("(with-mutex m (lambda () (car 'a)))")); err == nil {
+		t.Fatal("Expected with-mutex to fail")
+	}
+	assertEvaluates(t, interp, "(with-mutex m (lambda () 'b))", Symbol("b"))
+}
+
+func TestExitReason(t *testing.T) {
+	interp := NewInterpreter(DefaultEnvironment)
+	reason := assertEvaluates(t, interp, "((lambda (p) (receive (('exit pid reason) reason))) (spawn-link (lambda () (error 'oops 'a))))", nil)
+	var raised *UserRaisedError
+	if r, ok := reason.(*ExitReason); !ok || !errors.As(r.Err, &raised) || raised.Message != Symbol("oops") {
+		t.Errorf("Expected the reason to be the error raised by the process but was %v", reason)
+	}
+}
+
+func TestCoroutineState(t *testing.T) {
+	interp := NewInterpreter(DefaultEnvironment)
+
+	// a coroutine may be resumed by another thread
+	assertEvaluates(t, interp, "(define co (make-coroutine (lambda (x) (yield x))))", nil)
+	assertEvaluates(t, interp, "(define t (pexec (resume co 1)))", nil)
+	assertEvaluates(t, interp, "(t)", Integer(1))
+	assertEvaluates(t, interp, "(resume co 2)", Integer(2))
+	assertEvaluates(t, interp, "(coroutine-done? co)", True)
+
+	// a coroutine which fails is dead
+	assertEvaluates(t, interp, "(define failing (make-coroutine (lambda (x) (car x))))", nil)
+	assertFails(t, interp, "(resume failing 'a)", "<built-in car> expects a pair but was given a")
+	assertEvaluates(t, interp, "(coroutine-done? failing)", True)
+	assertFails(t, interp, "(resume failing 'b)", "resume of dead coroutine")
+}
+
+func TestContinuationsEnterAndLeaveBlocks(t *testing.T) {
+	interp := NewInterpreter(DefaultEnvironment)
+	assertEvaluates(t, interp, "(define m (make-mutex))", nil)
+	assertEvaluates(t, interp, "(define tv (make-tvar 'a))", nil)
+
+	// re-entering a with-mutex block after it returned does not release the mutex again
+	assertEvaluates(t, interp, "(define r (with-mutex m (lambda () (call/cc (lambda (k) k)))))", nil)
+	assertEvaluates(t, interp, "(r 'again)", nil)
+	assertEvaluates(t, interp, "r", Symbol("again"))
+	assertEvaluates(t, interp, "(with-mutex m (lambda () 'free))", Symbol("free"))
+
+	// escaping from a with-mutex block releases the mutex
+	assertEvaluates(t, interp, "((lambda (x) (with-mutex m (lambda () x))) (call/cc (lambda (k) (with-mutex m (lambda () (k 'escaped))))))", Symbol("escaped"))
+
+	// escaping from an atomically block abandons the transaction
+	assertFails(t, interp, "((lambda (x) (tvar-set! tv x)) (call/cc (lambda (k) (atomically (lambda () (k 'b))))))", "tvar-set! outside of atomically")
+	assertEvaluates(t, interp, "(tvar-ref tv)", Symbol("a"))
+}
+
+func TestDeterministicScheduler(t *testing.T) {
+	program := []string{
+		"(define c (make-channel 3))",
+		"(define t1 (pexec (channel-send c 'a)))",
+		"(define t2 (pexec (channel-send c 'b)))",
+		"(define t3 (pexec (channel-send c 'c)))",
+		"(cons (channel-receive c) (cons (channel-receive c) (cons (channel-receive c) '())))",
+	}
+	run := func(seed int64) string {
+		interp := NewInterpreter(DefaultEnvironment, WithDeterministicScheduler(seed))
+		var result SExpr
+		for _, input := range program {
+			result = assertEvaluates(t, interp, input, nil)
+		}
+		return result.String()
+	}
+	orders := map[string]bool{}
+	for seed := int64(0); seed < 20; seed++ {
+		first := run(seed)
+		if second := run(seed); first != second {
+			t.Errorf("Seed %d produced %v and then %v", seed, first, second)
+		}
+		orders[first] = true
+	}
+	if len(orders) < 2 {
+		t.Errorf("Expected different seeds to produce different interleavings but got %v", orders)
+	}
+}
+
+func TestDeterministicSchedulerTimeouts(t *testing.T) {
+	interp := NewInterpreter(DefaultEnvironment, WithDeterministicScheduler(1))
+	assertEvaluates(t, interp, "(define c (make-channel))", nil)
+	assertEvaluates(t, interp, "(select (c x x) (after 1000000 'timeout))", Symbol("timeout"))
+	if _, err := interp.Evaluate(mustParse("(channel-receive c)")); err != Deadlock {
+		t.Fatalf("Expected %v but was %v", Deadlock, err)
+	}
+}
+
+func TestDeterministicSchedulerSelect(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		interp := NewInterpreter(DefaultEnvironment, WithDeterministicScheduler(7))
+		assertEvaluates(t, interp, "(define a (make-channel 1))", nil)
+		assertEvaluates(t, interp, "(define b (make-channel 1))", nil)
+		assertEvaluates(t, interp, "(channel-send a 'a)", nil)
+		assertEvaluates(t, interp, "(channel-send b 'b)", nil)
+		assertEvaluates(t, interp, "(select (a x x) (b y y))", Symbol("a"))
+	}
+}
+
+func TestEmbeddedFunctions(t *testing.T) {
+	interp := NewInterpreter(DefaultEnvironment,
+		WithFunc("list", func(args ...SExpr) (SExpr, error) {
+			return List(args...), nil
+		}),
+		WithFunc("add", func(a, b int) int {
+			return a + b
+		}),
+		WithFunc("half", func(f float64) (float64, error) {
+			if f < 0 {
+				return 0, errors.New("negative")
+			}
+			return f / 2, nil
+		}),
+		WithFunc("join", func(sep string, parts ...string) string {
+			return strings.Join(parts, sep)
+		}),
+	)
+	interp.Define("answer", Integer(42))
+
+	assertEvaluates(t, interp, "(list 'a 'b)", List(Symbol("a"), Symbol("b")))
+	assertEvaluates(t, interp, "(add answer 1)", Integer(43))
+	assertEvaluates(t, interp, "(half 3)", Float(1.5))
+	assertEvaluates(t, interp, "(join '- 'a 'b 'c)", Symbol("a-b-c"))
+	assertFails(t, interp, "(add 1)", "<built-in add> expects 2 arguments but was given 1")
+	assertFails(t, interp, "(add 'a 1)", "<built-in add> argument 1: cannot convert a to int")
+	assertFails(t, interp, "(half (- 0 1))", "negative")
+	assertFails(t, interp, "(join)", "<built-in join> expects at least 1 arguments but was given 0")
+}
+
+func TestEmbeddedFunctionPurity(t *testing.T) {
+	calls := 0
+	interp := NewInterpreter(DefaultEnvironment,
+		WithFunc("count", func() int {
+			calls++
+			return calls
+		}),
+		WithPureFunc("double", func(n int) int {
+			return 2 * n
+		}),
+	)
+	assertEvaluates(t, interp, "(pure? (lambda () (count)))", False)
+	assertEvaluates(t, interp, "(pure? (lambda (x) (double x)))", True)
+	assertEvaluates(t, interp, "(pure? (lambda (x) (+ x 1)))", True)
+	assertFails(t, interp, "(define-memoized counter (lambda (x) (count)))", "cannot memoize impure closure: <closure>")
+	assertEvaluates(t, interp, "(define-memoized twice (lambda (x) (double x)))", nil)
+	assertEvaluates(t, interp, "(twice 2)", Integer(4))
+}
+
+func TestNames(t *testing.T) {
+	interp := NewInterpreter(MakeEnviron(Symbol("car"), Invariant("car"), Symbol("cdr"), Invariant("cdr")))
+	interp.Define("answer", Integer(42))
+	assertEvaluates(t, interp, "(define car 'shadowed)", nil)
+	names := interp.Names()
+	if fmt.Sprint(names) != "[answer car cdr]" {
+		t.Errorf("Expected [answer car cdr] but was %v", names)
+	}
+}
+
+type constThunk struct{ value SExpr }
+
+func (constThunk) String() string              { return "<const>" }
+func (t constThunk) GetResult() (SExpr, error) { return t.value, nil }
+
+func TestCall(t *testing.T) {
+	interp := NewInterpreter(DefaultEnvironment, WithFunc("go-add", func(a, b int) int { return a + b }))
+	assertEvaluates(t, interp, "(define add (lambda (a b) (+ a b)))", nil)
+	add, _ := interp.Evaluate(mustParse("add"))
+	builtin, _ := interp.Evaluate(mustParse("go-add"))
+	cont, _ := interp.Evaluate(mustParse("(cons 'a (call/cc (lambda (k) k)))"))
+	cont = Cdr(cont)
+
+	cases := []struct {
+		proc     SExpr
+		args     []SExpr
+		expected SExpr
+	}{
+		{add, []SExpr{Integer(1), Integer(2)}, Integer(3)},
+		{builtin, []SExpr{Integer(1), Integer(2)}, Integer(3)},
+		{Invariant("car"), []SExpr{List(Symbol("x"), Symbol("y"))}, Symbol("x")},
+		{Invariant("cons"), []SExpr{Symbol("x"), Null}, List(Symbol("x"))},
+		{cont, []SExpr{Symbol("b")}, Cons(Symbol("a"), Symbol("b"))},
+		{constThunk{Symbol("c")}, nil, Symbol("c")},
+	}
+	for _, c := range cases {
+		actual, err := interp.Call(c.proc, c.args...)
+		if err != nil {
+			t.Errorf("Call(%v, %v) failed: %v", c.proc, c.args, err)
+		} else if !IsEqStar(actual, c.expected) {
+			t.Errorf("Call(%v, %v) = %v, expected %v", c.proc, c.args, actual, c.expected)
+		}
+	}
+
+	if _, err := interp.Call(add, Integer(1)); err == nil {
+		t.Errorf("Call with too few arguments should fail")
+	}
+	if _, err := interp.Call(Integer(1)); err == nil {
+		t.Errorf("Call of a non-procedure should fail")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				actual, err := interp.Call(add, Integer(i), Integer(j))
+				if err != nil {
+					t.Error(err)
+				} else if !IsEq(actual, Integer(i+j)) {
+					t.Errorf("Expected %d but was %v", i+j, actual)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestEvaluateContext(t *testing.T) {
+	omega := mustParse("((lambda (x) (x x)) (lambda (x) (x x)))")
+	interp := NewInterpreter(DefaultEnvironment)
+	assertEvaluates(t, interp, "(define count (lambda (n) (cond ((eq? n 0) 0) (else (+ 1 (count (- n 1)))))))", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := interp.EvaluateContext(ctx, omega); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v but was %v", context.DeadlineExceeded, err)
+	}
+
+	ctx = ContextWithLimits(context.Background(), Limits{Fuel: 1000})
+	var fuelErr *FuelExhaustedError
+	if _, err := interp.EvaluateContext(ctx, omega); !errors.As(err, &fuelErr) || fuelErr.Fuel != 1000 {
+		t.Errorf("Expected fuel to be exhausted but was %v", err)
+	}
+	if result, err := interp.EvaluateContext(ctx, mustParse("(count 10)")); err != nil || !IsEq(result, Integer(10)) {
+		t.Errorf("Expected 10 but was %v, %v", result, err)
+	}
+
+	ctx = ContextWithLimits(context.Background(), Limits{MaxDepth: 100})
+	var depthErr *DepthExceededError
+	if _, err := interp.EvaluateContext(ctx, mustParse("(count 1000)")); !errors.As(err, &depthErr) || depthErr.MaxDepth != 100 {
+		t.Errorf("Expected maximum depth to be exceeded but was %v", err)
+	}
+	if result, err := interp.EvaluateContext(ctx, mustParse("(count 10)")); err != nil || !IsEq(result, Integer(10)) {
+		t.Errorf("Expected 10 but was %v, %v", result, err)
+	}
+
+	limited := NewInterpreter(DefaultEnvironment, WithLimits(Limits{Fuel: 1000}))
+	if _, err := limited.Evaluate(mustParse("((pexec ((lambda (x) (x x)) (lambda (x) (x x)))))")); !errors.As(err, &fuelErr) {
+		t.Errorf("Expected fuel to be exhausted but was %v", err)
+	}
+}
+
+func TestAllocLimit(t *testing.T) {
+	interp := NewInterpreter(DefaultEnvironment, WithLimits(Limits{MaxAlloc: 1 << 20}))
+	assertEvaluates(t, interp, "(define build (lambda (l) (build (cons 'x l))))", nil)
+	assertEvaluates(t, interp, "(cons 'a '())", List(Symbol("a")))
+
+	var allocErr *AllocLimitError
+	if _, err := interp.Evaluate(mustParse("(build '())")); !errors.As(err, &allocErr) || allocErr.MaxAlloc != 1<<20 {
+		t.Errorf("Expected the allocation limit to be exceeded but was %v", err)
+	}
+	ctx := ContextWithLimits(context.Background(), Limits{MaxAlloc: 1 << 10})
+	if _, err := interp.EvaluateContext(ctx, mustParse("(pmap (lambda (x) (build '())) '(1 2))")); !errors.As(err, &allocErr) || allocErr.MaxAlloc != 1<<10 {
+		t.Errorf("Expected the allocation limit to be exceeded but was %v", err)
+	}
+
+	// values allocated by primitives and embedded functions are counted
+	if _, err := interp.Evaluate(mustParse("(make-channel 1000000000000)")); !errors.As(err, &allocErr) {
+		t.Errorf("Expected the allocation limit to be exceeded but was %v", err)
+	}
+	interp = NewInterpreter(DefaultEnvironment, WithLimits(Limits{MaxAlloc: 1 << 20}), WithFunc("zeros", func(n int) []int {
+		return make([]int, n)
+	}))
+	assertEvaluates(t, interp, "(car (zeros 10))", Integer(0))
+	if _, err := interp.Evaluate(mustParse("(car (zeros 100000))")); !errors.As(err, &allocErr) {
+		t.Errorf("Expected the allocation limit to be exceeded but was %v", err)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	pure, err := ProfileEnvironment("pure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	interp := NewInterpreter(pure)
+	assertEvaluates(t, interp, "(cons (+ 1 2) '(a))", List(Integer(3), Symbol("a")))
+	assertFails(t, interp, "(exit)", `environment lookup failed for symbol "exit"`)
+	assertFails(t, interp, "(make-channel 1)", `environment lookup failed for symbol "make-channel"`)
+
+	safe, err := ProfileEnvironment("safe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	interp = NewInterpreter(safe)
+	assertEvaluates(t, interp, "(pmap (lambda (x) (+ x 1)) '(1 2))", List(Integer(2), Integer(3)))
+	assertFails(t, interp, "(sleep 1)", `environment lookup failed for symbol "sleep"`)
+	assertFails(t, interp, "(env)", `environment lookup failed for symbol "env"`)
+
+	full, err := ProfileEnvironment("full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full.String() != DefaultEnvironment.String() {
+		t.Errorf("Expected the full profile to be the default environment")
+	}
+
+	env, err := NewEnvironment("car", "time")
+	if err != nil {
+		t.Fatal(err)
+	}
+	interp = NewInterpreter(env)
+	assertEvaluates(t, interp, "(car '(a))", Symbol("a"))
+	assertFails(t, interp, "(cdr '(a))", `environment lookup failed for symbol "cdr"`)
+
+	if _, err := NewEnvironment("car", "open-file"); err == nil || err.Error() != "unknown primitive: open-file" {
+		t.Errorf("Expected unknown primitive but was %v", err)
+	}
+	if _, err := ProfileEnvironment("root"); err == nil {
+		t.Errorf("Expected unknown profile to fail")
+	}
+
+	Profiles()["pure"][0] = "exit"
+	if names := Profiles()["pure"]; names[0] != "car" {
+		t.Errorf("Expected changing the result of Profiles not to change the profiles but was %v", names)
+	}
+}
+
+func TestErrorTypes(t *testing.T) {
+	interp := NewInterpreter(DefaultEnvironment)
+	evaluate := func(input string) error {
+		_, err := interp.Evaluate(mustParse(input))
+		return err
+	}
+
+	var unbound *UnboundVariableError
+	if err := evaluate("(car (a b))"); !errors.As(err, &unbound) || unbound.Symbol != "a" || unbound.Pos.String() != "1:6" {
+		t.Errorf("Expected an unbound variable a at 1:6 but was %v", err)
+	}
+	var arity *ArityError
+	if err := evaluate("(cons 'a)"); !errors.As(err, &arity) || arity.Expected != 2 || arity.Actual != 1 || arity.Pos.String() != "1:1" {
+		t.Errorf("Expected an arity error at 1:1 but was %v", err)
+	}
+	if err := evaluate("((pexec (car '(a) 'b)))"); !errors.As(err, &arity) || !IsEq(arity.Proc, Invariant("car")) || arity.Pos.String() != "1:9" {
+		t.Errorf("Expected an arity error from car at 1:9 but was %v", err)
+	}
+	var typeErr *TypeError
+	if err := evaluate("(channel-send 'a 'b)"); !errors.As(err, &typeErr) || typeErr.Expected != "a channel" || !IsEq(typeErr.Value, Symbol("a")) {
+		t.Errorf("Expected a type error but was %v", err)
+	}
+	if err := evaluate("('a)"); !errors.As(err, &typeErr) || typeErr.Proc != nil || err.Error() != "Unknown operator: a" {
+		t.Errorf("Expected an unknown operator but was %v", err)
+	}
+	if err := evaluate("(car 'a)"); !errors.As(err, &typeErr) || !IsEq(typeErr.Proc, Invariant("car")) || typeErr.Expected != "a pair" || typeErr.Pos.String() != "1:1" {
+		t.Errorf("Expected a type error from car at 1:1 but was %v", err)
+	}
+	if err := evaluate("(+ 1 'a)"); !errors.As(err, &typeErr) || err.Error() != "<built-in +> expects a number but was given a" {
+		t.Errorf("Expected a type error from + but was %v", err)
+	}
+	if err := evaluate("(-)"); !errors.As(err, &arity) || !arity.Variadic || arity.Expected != 1 {
+		t.Errorf("Expected an arity error from - but was %v", err)
+	}
+
+	// errors are copied when they are annotated, as they may be shared between threads
+	shared := &TypeError{Proc: Invariant("car"), Expected: "a pair", Value: Symbol("a")}
+	annotated := annotate(shared, mustParse("(car 'a)"), newInterpStack(), CID)
+	if shared.Expr != nil || shared.Stack != nil || !errors.As(annotated, &typeErr) || typeErr.Expr == nil || typeErr.Stack == nil {
+		t.Errorf("Expected annotate to fill in a copy of the error but was %#v and %#v", shared, annotated)
+	}
+	var syntax *SyntaxError
+	if err := evaluate("(cons 'a (lambda))"); !errors.As(err, &syntax) || syntax.Expr.String() != "(lambda)" || syntax.Pos.String() != "1:10" {
+		t.Errorf("Expected a syntax error at 1:10 but was %v", err)
+	}
+	var raised *UserRaisedError
+	if err := evaluate("(error 'oops 1 'a)"); !errors.As(err, &raised) || err.Error() != "oops 1 a" || len(raised.Irritants) != 2 {
+		t.Errorf("Expected a raised error but was %v", err)
+	}
+	var exit *ExitError
+	if err := evaluate("(exit 3)"); !errors.As(err, &exit) || exit.Code != 3 || !errors.Is(err, Exit) {
+		t.Errorf("Expected exit with code 3 but was %v", err)
+	}
+	if err := evaluate("(exit)"); !errors.Is(err, Exit) || err.Error() != "interpreter exited" {
+		t.Errorf("Expected exit but was %v", err)
+	}
+
+	parser := parse.NewFileParser(strings.NewReader("(define f (lambda (x)\n  (car x 'y)))\n(f '(1))"), "test.scm")
+	for i := 0; i < 2; i++ {
+		expr, err := parser.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = interp.Evaluate(expr)
+		if i == 1 && (!errors.As(err, &arity) || arity.Pos.String() != "test.scm:2:3" || arity.Stack == nil) {
+			t.Errorf("Expected an arity error at test.scm:2:3 but was %v", err)
+		}
+	}
+}
+
+func TestBacktrace(t *testing.T) {
+	interp := NewInterpreter(DefaultEnvironment)
+	parser := parse.NewFileParser(strings.NewReader(`
+(define f (lambda (x) (car x 'y)))
+(define g (lambda (x) (cons 'a (f x))))
+(define h (lambda (x) (g x)))
+(h '(1))`), "test.scm")
+	var err error
+	for err == nil {
+		var expr SExpr
+		if expr, err = parser.Parse(); err != nil {
+			t.Fatal(err)
+		}
+		_, err = interp.Evaluate(expr)
+	}
+
+	c := ContextOf(err)
+	if c == nil {
+		t.Fatalf("Expected an error with a backtrace but was %v", err)
+	}
+	expected := "  in (f (1)) at test.scm:3:32\n  in (g (1)) at test.scm:4:23"
+	if c.Pos.String() != "test.scm:2:23" || c.Backtrace.String() != expected {
+		t.Errorf("Expected error at test.scm:2:23 with backtrace\n%v\nbut was at %v with\n%v", expected, c.Pos, c.Backtrace)
+	}
+
+	assertEvaluates(t, interp, "(define loop (lambda (n) (cond ((eq? n 0) (error 'done)) (else (loop (- n 1))))))", nil)
+	_, err = interp.Evaluate(mustParse("(loop 100)"))
+	if c := ContextOf(err); c == nil || len(c.Backtrace) != 1 || c.Backtrace[0].Name() != "loop" {
+		t.Errorf("Expected a single frame for a tail recursive loop but was %v", err)
+	}
+}
+
+func TestDebugger(t *testing.T) {
+	var output bytes.Buffer
+	debugger := NewDebugger(strings.NewReader("b f\nc\nbt\nl\np (cons x x)\nc\n\nq\n"), &output)
+	interp := NewInterpreter(DefaultEnvironment, WithDebugger(debugger))
+	parser := parse.NewFileParser(strings.NewReader(`
+(define f (lambda (x) (cons x (break))))
+(define g (lambda (y) (f y)))
+(g 'a)
+(g 'b)`), "test.scm")
+	var results []SExpr
+	var err error
+	for err == nil {
+		var expr, result SExpr
+		if expr, err = parser.Parse(); err != nil {
+			break
+		}
+		if result, err = interp.Evaluate(expr); err == nil {
+			results = append(results, result)
+		}
+	}
+
+	if !errors.Is(err, Quit) || len(results) != 3 || results[2].String() != "(a)" {
+		t.Errorf("Expected the debugger to quit after evaluating (g 'a) but was %v after %v", err, results)
+	}
+	expected := `test.scm:2:1: (define f (lambda (x) (cons x (break))))
+(debug) breakpoint 1 at f
+(debug) test.scm:2:23: (cons x (break))
+(debug)   in (f a) at test.scm:3:23
+(debug)   x = a
+(debug) (a . a)
+(debug) => <null>
+(debug) test.scm:2:23: (cons x (break))
+(debug) `
+	if !strings.HasPrefix(output.String(), expected) {
+		t.Errorf("Expected debugger output\n%v\nbut was\n%v", expected, output.String())
+	}
+}
+
+type recordingTracer struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recordingTracer) Enter(frame *Frame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, fmt.Sprintf("enter %v %d", frame, frame.Depth))
+}
+
+func (r *recordingTracer) Return(frame *Frame, result SExpr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, fmt.Sprintf("return %v %v", frame, result))
+}
+
+func (r *recordingTracer) Error(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, fmt.Sprintf("error %v", err))
+}
+
+func TestTrace(t *testing.T) {
+	var output bytes.Buffer
+	tracer := &recordingTracer{}
+	interp := NewInterpreter(DefaultEnvironment, WithTracer(tracer), WithTraceOutput(&output))
+	assertEvaluates(t, interp, "(define len (lambda (x) (cond ((null? x) 0) (else (+ 1 (len (cdr x)))))))", nil)
+	assertEvaluates(t, interp, "(define loop (lambda (x n) (cond ((null? x) n) (else (loop (cdr x) (+ n 1))))))", nil)
+	assertEvaluates(t, interp, "(trace len loop)", nil)
+	assertEvaluates(t, interp, "(len '(a b))", nil)
+	assertEvaluates(t, interp, "(loop '(a b) 0)", nil)
+	assertEvaluates(t, interp, "(untrace len)", nil)
+	assertEvaluates(t, interp, "(len '(a b))", nil)
+	assertFails(t, interp, "(trace car)", "<built-in trace> expects a closure but was given <built-in car>")
+
+	expected := `(len (a b))
+| (len (b))
+| | (len <null>)
+| | 0
+| 1
+2
+(loop (a b) 0)
+(loop (b) 1)
+(loop <null> 2)
+2
+`
+	if output.String() != expected {
+		t.Errorf("Expected trace\n%v\nbut was\n%v", expected, output.String())
+	}
+
+	tracer.events = nil
+	interp.Evaluate(mustParse("(loop '(a) 0)"))
+	interp.Evaluate(mustParse("(len 'a)"))
+	events := []string{
+		"enter (loop (a) 0) 0",
+		"enter (loop <null> 1) 0",
+		"return (loop <null> 1) 1",
+		"enter (len a) 0",
+		"error <built-in cdr> expects a pair but was given a",
+	}
+	if strings.Join(tracer.events, "\n") != strings.Join(events, "\n") {
+		t.Errorf("Expected tracer events\n%v\nbut was\n%v", strings.Join(events, "\n"), strings.Join(tracer.events, "\n"))
+	}
+}
+
+func TestProfiler(t *testing.T) {
+	profiler := NewProfiler(time.Millisecond)
+	interp := NewInterpreter(DefaultEnvironment, WithProfiler(profiler))
+	profiler.Start()
+	assertEvaluates(t, interp, "(define fib (lambda (n) (cond ((eq? n 0) 0) ((eq? n 1) 1) (else (+ (fib (- n 1)) (fib (- n 2)))))))", nil)
+	assertEvaluates(t, interp, "(fib 10)", Integer(55))
+	profiler.Stop()
+
+	var report bytes.Buffer
+	if err := profiler.WriteReport(&report); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(report.String(), "\n")
+	calls := map[string]string{}
+	for _, line := range lines[1:] {
+		if fields := strings.Fields(line); len(fields) >= 6 {
+			calls[fields[5]] = fields[0]
+		}
+	}
+	if calls["fib"] != "177" || calls["+"] != "88" {
+		t.Errorf("Expected 177 calls of fib and 88 of + but the report was\n%v", report.String())
+	}
+
+	var profile bytes.Buffer
+	if err := profiler.WriteProfile(&profile); err != nil {
+		t.Fatal(err)
+	}
+	r, err := gzip.NewReader(&profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("fib")) || !bytes.Contains(data, []byte("nanoseconds")) {
+		t.Errorf("Expected a profile of fib but was %q", data)
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	source := `(define classify (lambda (x)
+  (cond ((null? x) 'empty)
+        ((eq? (car x) 'a) (if (null? (cdr x)) 'just-a 'a-and-more))
+        (else 'other))))
+(classify '(a))
+(classify '(b))
+`
+	file, err := ioutil.TempFile("", "coverage*.scm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(source); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	coverage := NewCoverage()
+	interp := NewInterpreter(DefaultEnvironment, WithCoverage(coverage))
+	parser := parse.NewFileParser(strings.NewReader(source), file.Name())
+	for {
+		expr, err := parser.Parse()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := interp.Evaluate(expr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var summary bytes.Buffer
+	if err := coverage.WriteSummary(&summary); err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf(`%[1]s: 87.5%% of 16 expressions, 3 of 5 branches
+not evaluated:
+  %[1]s:2:9 (branch)
+  %[1]s:3:55 (branch)
+`, file.Name())
+	if summary.String() != expected {
+		t.Errorf("Expected coverage summary\n%v\nbut was\n%v", expected, summary.String())
+	}
+
+	var page bytes.Buffer
+	if err := coverage.WriteHTML(&page); err != nil {
+		t.Fatal(err)
+	}
+	uncovered := `<span class="uncov" title="evaluated 0 times">&#39;a-and-more</span>`
+	if !strings.Contains(page.String(), uncovered) {
+		t.Errorf("Expected the HTML report to contain %v but was\n%v", uncovered, page.String())
+	}
+}
+
+func TestTestForms(t *testing.T) {
+	var output bytes.Buffer
+	runner := NewTestRunner(&output)
+	interp := NewInterpreter(DefaultEnvironment, WithTestRunner(runner))
+	parser := parse.NewFileParser(strings.NewReader(`(test-begin 'arith)
+(test-equal 'adds 3 (+ 1 2))
+(test-equal 4 (+ 1 2))
+(test-assert (eq? 'a 'a))
+(test-assert 'fails (null? '(a)))
+(test-error 'car-of-atom (car 'a))
+(test-error (car '(a)))
+(test-equal 'errors 1 (car 'a))
+(test-end 'arith)`), "arith_test.scm")
+	for {
+		expr, err := parser.Parse()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := interp.Evaluate(expr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := `FAIL arith/(test-equal 4 (+ 1 2)) at arith_test.scm:3:1: expected 4 but was 3
+FAIL arith/fails at arith_test.scm:5:1: assertion was #f
+FAIL arith/(test-error (car '(a))) at arith_test.scm:7:1: expected an error but was a
+FAIL arith/errors at arith_test.scm:8:1: <built-in car> expects a pair but was given a
+arith: 3 passed, 4 failed
+`
+	if output.String() != expected {
+		t.Errorf("Expected test output\n%v\nbut was\n%v", expected, output.String())
+	}
+	if results := runner.Results(); len(results) != 7 || !results[0].Passed || results[0].Name != "adds" {
+		t.Errorf("Expected 7 results starting with a passing test named adds but was %v", results)
+	}
+
+	assertFails(t, interp, "(test-end)", "test-end without test-begin")
+	assertEvaluates(t, interp, "(test-begin 'a)", nil)
+	assertFails(t, interp, "(test-end 'b)", "test-end b does not match test-begin a")
+	assertFails(t, interp, "(test-equal 1)", "invalid test-equal: (test-equal 1)")
+}
+
+func TestProperties(t *testing.T) {
+	runner := NewTestRunner(nil)
+	runner.SetSeed(42)
+	interp := NewInterpreter(DefaultEnvironment, WithTestRunner(runner))
+	assertEvaluates(t, interp, "(check-property 'commutes ((x (gen-integer)) (y (gen-integer))) (eq? (+ x y) (+ y x)))", Null)
+	assertEvaluates(t, interp, "(check-property 'square 20 ((x (gen-integer 1 100))) (eq? (* x x) x))", Null)
+	assertEvaluates(t, interp, `(check-property ((l (gen-list (gen-integer))))
+	  (cond ((null? l) #t) ((null? (cdr l)) #t) (else (car 'a))))`, Null)
+	assertEvaluates(t, interp, "(check-property 'sexprs ((s (gen-sexpr)) (o (gen-one-of 'a 'b))) (eq? o o))", Null)
+
+	results := runner.Results()
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 results but was %v", results)
+	}
+	if !results[0].Passed || !results[3].Passed {
+		t.Errorf("Expected commutes and sexprs to pass but was %v", results)
+	}
+	expected := []string{"square", "by (x 2): #f (seed 42,"}
+	for _, s := range expected {
+		if !strings.Contains(results[1].String(), s) {
+			t.Errorf("Expected %q in %v", s, results[1])
+		}
+	}
+	if !strings.Contains(results[2].Message, "by (l (0 0)): <built-in car> expects a pair but was given a") {
+		t.Errorf("Expected the list to shrink to (0 0) but was %v", results[2])
+	}
+
+	assertFails(t, interp, "(check-property ((x)) #t)", "invalid check-property binding: (x)")
+	assertFails(t, interp, "(check-property ((x 'a)) #t)", "check-property expects a generator but was given a")
+	assertFails(t, interp, "(gen-integer 2 1)", "gen-integer expects an upper bound which is not less than the lower bound: 2 1")
+	assertFails(t, interp, "(gen-list 'a)", "<built-in gen-list> expects a generator but was given a")
+	assertFails(t, interp, "(gen-sample (gen-integer) 9223372036854775807)", "<built-in gen-sample> expects a size between 0 and 50 but was given 9223372036854775807")
+	assertEvaluates(t, interp, "(pure? (lambda () (gen-sample (gen-integer))))", False)
+
+	// bounds and shrinking work across the whole range of integers
+	assertEvaluates(t, interp, "(gen-sample (gen-integer 0 9223372036854775807))", nil)
+	assertEvaluates(t, interp, "(gen-sample (gen-integer (- 0 9223372036854775807 1) 9223372036854775807))", nil)
+	assertEvaluates(t, interp, "(check-property 'wide ((x (gen-integer 1 9223372036854775807))) (eq? x 1))", Null)
+	if results := runner.Results(); !strings.Contains(results[len(results)-1].Message, "by (x 2)") {
+		t.Errorf("Expected the integer to shrink to 2 but was %v", results[len(results)-1])
+	}
+	if shrunk := shrinkInteger(math.MaxInt64, -5); !IsEq(shrunk[0], Integer(-5)) || !IsEq(shrunk[len(shrunk)-1], Integer(math.MaxInt64-1)) {
+		t.Errorf("Expected the integers from -5 to %d but was %v", int64(math.MaxInt64-1), shrunk)
+	}
+}
+
 func TestCanFormatRecursiveFunction(t *testing.T) {
 	interp := NewInterpreter(DefaultEnvironment)
 	assertEvaluates(t, interp, "(define len (lambda (x) (cond ((null? x) 0) (else (+ 1 (len (cdr x)))))))", nil)
@@ -229,6 +1265,15 @@ func assertEvaluates(t *testing.T, interp *Interpreter, input string, expected S
 	return expr
 }
 
+func assertFails(t *testing.T, interp *Interpreter, input string, msg string) {
+	_, err := interp.Evaluate(mustParse(input))
+	if err == nil {
+		t.Fatalf("Expected %q but %v succeeded", msg, input)
+	} else if err.Error() != msg {
+		t.Fatalf("Expected %q but was %q", msg, err.Error())
+	}
+}
+
 func mustParse(input string) SExpr {
 	expr, err := parse.Parse(input)
 	if err != nil {
@@ -311,7 +1356,7 @@ func TestEvaluatesTestCases(t *testing.T) {
 	for _, c := range testCases {
 		interp := NewInterpreter(c.env)
 		s := newInterpStack()
-		expr, err := interp.schemeValue(c.env, s, c.input)
+		expr, err := interp.schemeValue(context.Background(), c.env, s, c.input)
 		fail := c.check(t, expr, err)
 		if fail != "" {
 			var stack *interpStack
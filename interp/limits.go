@@ -0,0 +1,163 @@
+package interp
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+
+	. "github.com/zfjagann/gamma/sexpr"
+)
+
+// Limits bound the resources used by a single evaluation. A zero value means no limit.
+type Limits struct {
+	// Fuel is the number of steps the evaluation may take, including steps taken by its pexec and spawn threads.
+	Fuel int64
+	// MaxDepth is the number of pending continuations each thread of the evaluation may have.
+	MaxDepth int
+	// MaxAlloc is the approximate number of bytes the evaluation and its threads may allocate,
+	// counting the pairs, closures and continuations it creates, the buffers of its channels, the messages it sends,
+	// and the values returned by built-ins.
+	// Memory is counted when it is allocated, and is not returned when it is garbage collected.
+	MaxAlloc int64
+}
+
+// FuelExhaustedError is returned when an evaluation uses all of its fuel.
+type FuelExhaustedError struct {
+	Fuel int64
+}
+
+func (e *FuelExhaustedError) Error() string {
+	return fmt.Sprintf("fuel exhausted after %d steps", e.Fuel)
+}
+
+// DepthExceededError is returned when the continuation of an evaluation grows deeper than its limit.
+type DepthExceededError struct {
+	MaxDepth int
+}
+
+func (e *DepthExceededError) Error() string {
+	return fmt.Sprintf("maximum depth of %d exceeded", e.MaxDepth)
+}
+
+// AllocLimitError is returned when an evaluation allocates more memory than its limit.
+type AllocLimitError struct {
+	MaxAlloc int64
+}
+
+func (e *AllocLimitError) Error() string {
+	return fmt.Sprintf("resource exhausted: allocation limit of %d bytes exceeded", e.MaxAlloc)
+}
+
+// WithLimits sets the limits used by every evaluation of the interpreter.
+func WithLimits(limits Limits) Option {
+	return func(in *Interpreter) {
+		in.limits = limits
+	}
+}
+
+type limitsKey struct{}
+
+// ContextWithLimits returns a copy of `ctx` which makes EvaluateContext use `limits` instead of the limits of the interpreter.
+func ContextWithLimits(ctx context.Context, limits Limits) context.Context {
+	return context.WithValue(ctx, limitsKey{}, limits)
+}
+
+// budget tracks the resources used by an evaluation and all of its threads.
+// A nil budget is unlimited.
+type budget struct {
+	Limits
+	steps     int64
+	allocated int64
+}
+
+type allocKind int
+
+const (
+	allocPair allocKind = iota
+	allocClosure
+	allocContinuation
+	allocString
+	allocSlot // an element of a channel buffer or mailbox
+)
+
+// the approximate size in bytes of each kind of allocation
+var allocSizes = [...]int64{
+	allocPair:         int64(reflect.TypeOf(Pair{}).Size()),
+	allocClosure:      int64(reflect.TypeOf(Closure{}).Size()),
+	allocContinuation: int64(reflect.TypeOf(interpContinuation{}).Size()),
+	allocString:       1,
+	allocSlot:         int64(reflect.TypeOf((*SExpr)(nil)).Elem().Size()),
+}
+
+type budgetKey struct{}
+
+// newBudget returns the budget for an evaluation with `ctx`, or nil if it is unlimited.
+func (in *Interpreter) newBudget(ctx context.Context) *budget {
+	limits := in.limits
+	if l, ok := ctx.Value(limitsKey{}).(Limits); ok {
+		limits = l
+	}
+	if limits == (Limits{}) {
+		return nil
+	}
+	return &budget{Limits: limits}
+}
+
+func budgetFromContext(ctx context.Context) *budget {
+	b, _ := ctx.Value(budgetKey{}).(*budget)
+	return b
+}
+
+// step records a step of evaluation with the continuation `C`, and checks that the evaluation is within its limits.
+func (b *budget) step(C SExpr) error {
+	if b == nil {
+		return nil
+	}
+	if b.Fuel > 0 && atomic.AddInt64(&b.steps, 1) > b.Fuel {
+		return &FuelExhaustedError{b.Fuel}
+	}
+	if b.MaxDepth > 0 && depthOf(C) > b.MaxDepth {
+		return &DepthExceededError{b.MaxDepth}
+	}
+	if b.MaxAlloc > 0 && atomic.LoadInt64(&b.allocated) > b.MaxAlloc {
+		return &AllocLimitError{b.MaxAlloc}
+	}
+	return nil
+}
+
+// alloc records the allocation of `n` values of kind `kind`. The limit is checked by the next step.
+func (b *budget) alloc(kind allocKind, n int) {
+	if b != nil && b.MaxAlloc > 0 {
+		atomic.AddInt64(&b.allocated, int64(n)*allocSizes[kind])
+	}
+}
+
+// reserve records the allocation of `n` values of kind `kind`, and fails immediately if it exceeds the limit.
+// It is used before allocations whose size is chosen by the program, which may not fit in memory.
+func (b *budget) reserve(kind allocKind, n int) error {
+	if b == nil || b.MaxAlloc <= 0 {
+		return nil
+	}
+	if int64(n) > b.MaxAlloc/allocSizes[kind] {
+		return &AllocLimitError{b.MaxAlloc}
+	}
+	if atomic.AddInt64(&b.allocated, int64(n)*allocSizes[kind]) > b.MaxAlloc {
+		return &AllocLimitError{b.MaxAlloc}
+	}
+	return nil
+}
+
+// allocValue records the allocation of the pairs and symbols of `e`, a value created outside of the interpreter.
+func (b *budget) allocValue(e SExpr) {
+	if b == nil || b.MaxAlloc <= 0 {
+		return
+	}
+	for ; IsPair(e); e = Cdr(e) {
+		b.alloc(allocPair, 1)
+		b.allocValue(Car(e))
+	}
+	if sym, ok := e.(Symbol); ok {
+		b.alloc(allocString, len(sym))
+	}
+}
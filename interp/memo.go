@@ -0,0 +1,204 @@
+package interp
+
+import (
+	"sync"
+
+	. "github.com/zfjagann/gamma/sexpr"
+)
+
+// Primitives which make a closure ineligible for memoization.
+var impurePrimitives = map[string]bool{
+	"sleep": true,
+	"time":  true,
+	"exit":  true,
+	"env":   true,
+
+	"gen-sample": true,
+
+	"trace":   true,
+	"untrace": true,
+	"break":   true,
+
+	"test-begin": true,
+	"test-end":   true,
+
+	"make-channel":    true,
+	"channel-send":    true,
+	"channel-receive": true,
+	"channel-close":   true,
+
+	"task-cancel": true,
+	"task-wait":   true,
+	"task-done?":  true,
+
+	"spawn":      true,
+	"spawn-link": true,
+	"link":       true,
+	"self":       true,
+	"send":       true,
+
+	"make-coroutine":  true,
+	"make-generator":  true,
+	"resume":          true,
+	"generator-next":  true,
+	"yield":           true,
+	"coroutine-done?": true,
+	"generator->list": true,
+	"spawn-green":     true,
+	"thread-yield":    true,
+
+	"make-mutex":       true,
+	"with-mutex":       true,
+	"make-atomic":      true,
+	"atomic-ref":       true,
+	"atomic-swap!":     true,
+	"compare-and-set!": true,
+	"make-tvar":        true,
+	"tvar-ref":         true,
+	"tvar-set!":        true,
+	"atomically":       true,
+	"retry":            true,
+}
+
+// Memoized wraps a closure with a cache of its results.
+// Arguments are matched against previous calls using IsEqStar.
+type Memoized struct {
+	Closure *Closure
+
+	mu    sync.Mutex
+	cache map[string][]memoEntry
+}
+
+type memoEntry struct {
+	args   SExpr
+	result SExpr
+}
+
+func newMemoized(clos *Closure) *Memoized {
+	return &Memoized{Closure: clos, cache: make(map[string][]memoEntry)}
+}
+
+func (*Memoized) String() string {
+	return "<memoized closure>"
+}
+
+func (m *Memoized) lookup(args SExpr) (SExpr, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, entry := range m.cache[args.String()] {
+		if IsEqStar(entry.args, args) {
+			return entry.result, true
+		}
+	}
+	return nil, false
+}
+
+func (m *Memoized) store(args, result SExpr) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := args.String()
+	for _, entry := range m.cache[key] {
+		if IsEqStar(entry.args, args) {
+			// Another goroutine computed the same result first.
+			return
+		}
+	}
+	m.cache[key] = append(m.cache[key], memoEntry{args, result})
+}
+
+/**
+*** Purity Analysis
+**/
+
+// isPure reports whether `clos` can be memoized.
+// A closure is impure if its body uses define, pexec, select, receive or a test form, or calls (directly or through other closures) an impure primitive.
+// Symbols which are not bound yet are assumed to be pure.
+func isPure(clos *Closure) bool {
+	return pureClosure(clos, map[*Closure]bool{})
+}
+
+func pureClosure(clos *Closure, visited map[*Closure]bool) bool {
+	if visited[clos] {
+		return true
+	}
+	visited[clos] = true
+	return pureExpr(clos.Body, clos.Env, bound(nil, clos.SymList), visited)
+}
+
+func pureExpr(expr SExpr, env *Environ, locals map[Symbol]bool, visited map[*Closure]bool) bool {
+	if sym, ok := expr.(Symbol); ok {
+		if locals[sym] {
+			return true
+		}
+		val, found := env.Get(sym)
+		if !found {
+			return true
+		}
+		return pureValue(val, visited)
+	}
+	p, ok := expr.(*Pair)
+	if !ok {
+		// Atoms and quoted expressions are data.
+		return true
+	}
+	if IsEq(p.Car, defineLiteral) || IsEq(p.Car, defineMemoizedLiteral) || IsEq(p.Car, pexecLiteral) || IsEq(p.Car, selectLiteral) || IsEq(p.Car, receiveLiteral) {
+		return false
+	}
+	if IsEq(p.Car, testEqualLiteral) || IsEq(p.Car, testAssertLiteral) || IsEq(p.Car, testErrorLiteral) || IsEq(p.Car, checkPropertyLiteral) {
+		// Tests record their results in the current test group.
+		return false
+	}
+	if IsEq(p.Car, lambdaLiteral) {
+		argList, err := ECadr(expr)
+		if err != nil {
+			return true
+		}
+		body, err := ECaddr(expr)
+		if err != nil {
+			return true
+		}
+		return pureExpr(body, env, bound(locals, argList), visited)
+	}
+	for cur := expr; IsPair(cur); cur = Cdr(cur) {
+		if !pureExpr(Car(cur), env, locals, visited) {
+			return false
+		}
+	}
+	return true
+}
+
+func pureValue(val SExpr, visited map[*Closure]bool) bool {
+	switch v := val.(type) {
+	case builtin:
+		return v.pure
+	case Invariant:
+		return !impurePrimitives[string(v)]
+	case *Closure:
+		return pureClosure(v, visited)
+	case *Memoized:
+		return pureClosure(v.Closure, visited)
+	}
+	return true
+}
+
+// bound returns a copy of `locals` extended with the symbols in `symList`
+func bound(locals map[Symbol]bool, symList SExpr) map[Symbol]bool {
+	result := make(map[Symbol]bool, len(locals))
+	for k := range locals {
+		result[k] = true
+	}
+	for {
+		if sym, ok := symList.(Symbol); ok {
+			result[sym] = true
+			return result
+		}
+		p, ok := symList.(*Pair)
+		if !ok {
+			return result
+		}
+		if sym, ok := p.Car.(Symbol); ok {
+			result[sym] = true
+		}
+		symList = p.Cdr
+	}
+}
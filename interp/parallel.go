@@ -0,0 +1,162 @@
+package interp
+
+import (
+	"context"
+	"sync"
+
+	. "github.com/zfjagann/gamma/sexpr"
+)
+
+// parallel runs `job` for each index in `[0, n)` using at most `in.workers` threads.
+// If any job fails, the remaining jobs are cancelled and the first failure is returned as a PexecError.
+// Under the deterministic scheduler, the jobs are run in order by the calling thread.
+func (in *Interpreter) parallel(ctx context.Context, n int, job func(ctx context.Context, stack *interpStack, i int) error) error {
+	if in.sched != nil {
+		for i := 0; i < n; i++ {
+			stack := newInterpStack()
+			if err := job(ctx, stack, i); err != nil {
+				return &PexecError{err, stack}
+			}
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+		jobs     = make(chan int)
+	)
+	workers := in.workers
+	if workers > n {
+		workers = n
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				stack := newInterpStack()
+				if err := job(ctx, stack, i); err != nil {
+					once.Do(func() {
+						firstErr = &PexecError{err, stack}
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// pmap applies `proc` to every value in `items` in parallel, returning the results in order.
+func (in *Interpreter) pmap(ctx context.Context, proc SExpr, items []SExpr) ([]SExpr, error) {
+	results := make([]SExpr, len(items))
+	err := in.parallel(ctx, len(items), func(ctx context.Context, stack *interpStack, i int) error {
+		result, err := in.apply(ctx, stack, proc, List(items[i]))
+		results[i] = result
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// pfilter returns the values in `items` for which `proc` does not return #f, preserving their order.
+func (in *Interpreter) pfilter(ctx context.Context, proc SExpr, items []SExpr) ([]SExpr, error) {
+	keep, err := in.pmap(ctx, proc, items)
+	if err != nil {
+		return nil, err
+	}
+	results := []SExpr{}
+	for i, item := range items {
+		if !IsEq(keep[i], False) {
+			results = append(results, item)
+		}
+	}
+	return results, nil
+}
+
+// preduce combines `items` using `proc`, which must be associative with `init` as its identity.
+// The items are divided into one chunk per worker. Each chunk is reduced in parallel, then the results
+// of each chunk are combined in order.
+func (in *Interpreter) preduce(ctx context.Context, proc, init SExpr, items []SExpr) (SExpr, error) {
+	chunks := in.workers
+	if chunks > len(items) {
+		chunks = len(items)
+	}
+	partials := make([]SExpr, chunks)
+	reduce := func(ctx context.Context, stack *interpStack, acc SExpr, items []SExpr) (SExpr, error) {
+		for _, item := range items {
+			var err error
+			acc, err = in.apply(ctx, stack, proc, List(acc, item))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return acc, nil
+	}
+	err := in.parallel(ctx, chunks, func(ctx context.Context, stack *interpStack, i int) error {
+		start := i * len(items) / chunks
+		end := (i + 1) * len(items) / chunks
+		result, err := reduce(ctx, stack, init, items[start:end])
+		partials[i] = result
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	stack := newInterpStack()
+	result, err := reduce(ctx, stack, init, partials)
+	if err != nil {
+		return nil, &PexecError{err, stack}
+	}
+	return result, nil
+}
+
+// apply applies `proc` to the arguments in `randList` in a new evaluation
+func (in *Interpreter) apply(ctx context.Context, stack *interpStack, proc, randList SExpr) (SExpr, error) {
+	return in.schemeValue(ctx, in.globalEnv(), stack, application(proc, randList))
+}
+
+// application returns an expression which applies `proc` to the values in `randList` without evaluating them again.
+func application(proc, randList SExpr) SExpr {
+	args := []SExpr{}
+	for cur := randList; !IsNull(cur); cur = Cdr(cur) {
+		args = append(args, Quote(Car(cur)))
+	}
+	return Cons(Quote(proc), List(args...))
+}
+
+// listToSlice returns the values in `list`, or an error if `list` is not a proper list.
+func listToSlice(rator, list SExpr) ([]SExpr, error) {
+	items := []SExpr{}
+	for cur := list; !IsNull(cur); {
+		p, ok := cur.(*Pair)
+		if !ok {
+			return nil, &TypeError{Proc: rator, Expected: "a list", Value: list}
+		}
+		items = append(items, p.Car)
+		cur = p.Cdr
+	}
+	return items, nil
+}
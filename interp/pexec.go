@@ -1,28 +1,47 @@
 package interp
 
 import (
+	"context"
+	"reflect"
+	"time"
+
 	. "github.com/zfjagann/gamma/sexpr"
 )
 
-func (in *Interpreter) makePexec(env *Environ, val SExpr) SExpr {
-	// FIXME strong typing!
-	comms := make(chan *pexecResult, 1)
+// makePexec evaluates `val` in a new thread. If the evaluation fails, `onFail` is called
+// from the new thread before the failure is visible to other threads.
+func (in *Interpreter) makePexec(ctx context.Context, env *Environ, val SExpr, onFail func(error)) *Pexec {
+	// Cancelling the caller also cancels any tasks it started
+	ctx, cancel := context.WithCancel(ctx)
+	p := &Pexec{cancel: cancel, done: make(chan struct{})}
 
-	var rcomms chan<- *pexecResult = comms
+	var t *thread
+	if in.sched != nil {
+		t = in.sched.start()
+		ctx = context.WithValue(ctx, threadKey{}, t)
+	}
 
 	go func() {
+		defer cancel()
+		if t != nil {
+			<-t.wake
+			defer in.sched.exit(t)
+		}
 		result := &pexecResult{}
 		result.stack = newInterpStack()
-		result.expr, result.err = in.schemeValue(env, result.stack, val)
-		rcomms <- result
-		close(rcomms)
+		result.expr, result.err = in.schemeValue(ctx, env, result.stack, val)
+		if result.err != nil && onFail != nil {
+			onFail(result.err)
+		}
+		p.result = result
+		close(p.done)
 	}()
-	return &Pexec{comms, nil}
+	return p
 }
 
 type Pexec struct {
-	// FIXME strong typing!
-	comms  <-chan *pexecResult
+	cancel context.CancelFunc
+	done   chan struct{}
 	result *pexecResult
 }
 
@@ -30,11 +49,36 @@ func (*Pexec) String() string {
 	return "<pexec>"
 }
 
+// Cancel stops the task. The task will fail with `context.Canceled`
+// the next time it checks for cancellation.
+func (p *Pexec) Cancel() {
+	p.cancel()
+}
+
+// Done returns a channel that is closed when the task completes.
+func (p *Pexec) Done() <-chan struct{} {
+	return p.done
+}
+
 func (p *Pexec) GetResult() (SExpr, error) {
-	if p.result == nil {
-		p.result = <-p.comms
+	<-p.done
+	return p.getResult()
+}
+
+// waitPexec waits for the task `p` to complete and returns its result.
+// It returns `false` if `timeout` expires first. A negative timeout waits indefinitely.
+func (in *Interpreter) waitPexec(ctx context.Context, p *Pexec, timeout time.Duration) (SExpr, bool, error) {
+	chosen, _, _, err := in.selectCases(ctx, []reflect.SelectCase{recvCase(p.done)}, timeout)
+	if err != nil {
+		return nil, false, err
+	} else if chosen < 0 {
+		return nil, false, nil
 	}
+	result, err := p.getResult()
+	return result, true, err
+}
 
+func (p *Pexec) getResult() (SExpr, error) {
 	if p.result.err != nil {
 		return nil, &PexecError{p.result.err, p.result.stack}
 	} else {
@@ -56,3 +100,15 @@ type PexecError struct {
 func (p *PexecError) Error() string {
 	return p.Err.Error()
 }
+
+func (p *PexecError) Unwrap() error {
+	return p.Err
+}
+
+func toPexec(rator, e SExpr) (*Pexec, error) {
+	p, ok := e.(*Pexec)
+	if !ok {
+		return nil, &TypeError{Proc: rator, Expected: "a pexec", Value: e}
+	}
+	return p, nil
+}
@@ -0,0 +1,172 @@
+package interp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"time"
+)
+
+/**
+*** Encoding of profiles in the protocol buffer format of pprof, described by
+*** https://github.com/google/pprof/blob/main/proto/profile.proto
+**/
+
+type pprofProfile struct {
+	funcs    []profileFunc
+	samples  []*profileSample
+	period   time.Duration
+	start    time.Time
+	duration time.Duration
+}
+
+// field numbers of the messages in profile.proto
+const (
+	profileSampleType    = 1
+	profileSamples       = 2
+	profileLocation      = 4
+	profileFunction      = 5
+	profileStringTable   = 6
+	profileTimeNanos     = 9
+	profileDurationNanos = 10
+	profilePeriodType    = 11
+	profilePeriod        = 12
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	locationID   = 1
+	locationLine = 4
+
+	lineFunctionID = 1
+	lineLine       = 2
+
+	functionID         = 1
+	functionName       = 2
+	functionSystemName = 3
+	functionFilename   = 4
+	functionStartLine  = 5
+)
+
+// protoBuffer encodes the fields of a protocol buffer message
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.WriteByte(byte(x) | 0x80)
+		x >>= 7
+	}
+	b.WriteByte(byte(x))
+}
+
+func (b *protoBuffer) key(field int, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protoBuffer) int64(field int, x int64) {
+	if x != 0 {
+		b.key(field, 0)
+		b.varint(uint64(x))
+	}
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(data)))
+	b.Write(data)
+}
+
+func (b *protoBuffer) message(field int, m *protoBuffer) {
+	b.bytes(field, m.Bytes())
+}
+
+func (b *protoBuffer) packed(field int, xs []int64) {
+	var p protoBuffer
+	for _, x := range xs {
+		p.varint(uint64(x))
+	}
+	b.bytes(field, p.Bytes())
+}
+
+// stringTable assigns indexes to the strings of a profile. The first string is always empty.
+type stringTable struct {
+	strings []string
+	index   map[string]int64
+}
+
+func newStringTable() *stringTable {
+	return &stringTable{strings: []string{""}, index: map[string]int64{"": 0}}
+}
+
+func (t *stringTable) get(s string) int64 {
+	i, ok := t.index[s]
+	if !ok {
+		i = int64(len(t.strings))
+		t.index[s] = i
+		t.strings = append(t.strings, s)
+	}
+	return i
+}
+
+func (t *stringTable) valueType(typ, unit string) *protoBuffer {
+	var m protoBuffer
+	m.int64(valueTypeType, t.get(typ))
+	m.int64(valueTypeUnit, t.get(unit))
+	return &m
+}
+
+// writePprof writes `p` gzipped, as `go tool pprof` expects.
+// Each function has a single location with the same id, at the line where the function is defined.
+func writePprof(w io.Writer, p pprofProfile) error {
+	var b protoBuffer
+	strings := newStringTable()
+
+	b.message(profileSampleType, strings.valueType("samples", "count"))
+	b.message(profileSampleType, strings.valueType("time", "nanoseconds"))
+	for _, s := range p.samples {
+		var m protoBuffer
+		ids := make([]int64, len(s.stack))
+		for i, f := range s.stack {
+			ids[i] = int64(f) + 1
+		}
+		m.packed(sampleLocationID, ids)
+		m.packed(sampleValue, []int64{s.count, s.count * int64(p.period)})
+		b.message(profileSamples, &m)
+	}
+	for i, f := range p.funcs {
+		var line, loc protoBuffer
+		line.int64(lineFunctionID, int64(i)+1)
+		line.int64(lineLine, int64(f.Line))
+		loc.int64(locationID, int64(i)+1)
+		loc.message(locationLine, &line)
+		b.message(profileLocation, &loc)
+	}
+	for i, f := range p.funcs {
+		var fn protoBuffer
+		fn.int64(functionID, int64(i)+1)
+		fn.int64(functionName, strings.get(f.Name))
+		fn.int64(functionSystemName, strings.get(f.Name))
+		fn.int64(functionFilename, strings.get(f.File))
+		fn.int64(functionStartLine, int64(f.Line))
+		b.message(profileFunction, &fn)
+	}
+	b.int64(profileTimeNanos, p.start.UnixNano())
+	b.int64(profileDurationNanos, int64(p.duration))
+	b.message(profilePeriodType, strings.valueType("time", "nanoseconds"))
+	b.int64(profilePeriod, int64(p.period))
+	// the string table is written last, as encoding the other fields adds to it
+	for _, s := range strings.strings {
+		b.bytes(profileStringTable, []byte(s))
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(b.Bytes()); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,96 @@
+package interp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	. "github.com/zfjagann/gamma/sexpr"
+)
+
+var (
+	purePrimitives = []string{
+		"car", "cdr", "cons", "eq?", "symbol?", "null?", "apply", "call/cc", "error",
+		"+", "-", "*", "/",
+		"memoize", "pure?",
+		"test-begin", "test-end",
+		"gen-integer", "gen-float", "gen-symbol", "gen-boolean", "gen-list", "gen-sexpr", "gen-one-of",
+	}
+
+	safePrimitives = append(append([]string{}, purePrimitives...),
+		"make-channel", "channel-send", "channel-receive", "channel-close",
+		"task-cancel", "task-wait", "task-done?",
+		"pmap", "pfor-each", "pfilter", "preduce",
+		"make-mutex", "with-mutex",
+		"make-atomic", "atomic-ref", "atomic-swap!", "compare-and-set!",
+		"make-tvar", "tvar-ref", "tvar-set!", "atomically", "retry",
+		"spawn", "spawn-link", "link", "self", "send",
+		"make-coroutine", "resume", "yield", "coroutine-done?",
+		"make-generator", "generator-next", "generator->list",
+		"spawn-green", "thread-yield",
+		"gen-sample",
+	)
+)
+
+/*
+profiles are the named sets of primitives accepted by ProfileEnvironment.
+
+- `pure` contains only list operations, arithmetic, apply, call/cc, error, memoization and test groups.
+- `safe` adds the concurrency primitives, coroutines and actors.
+- `full` is every primitive in DefaultEnvironment, including exit, env, time, sleep, break, trace and untrace.
+
+Neither `pure` nor `safe` can access the host process or the environment of the interpreter, or read the clock.
+They can still wait for a time, with the timeout of task-wait or the after clause of select and receive.
+Special forms such as define, pexec, select, receive and test-equal are part of the language, and are available in every profile.
+*/
+var profiles = map[string][]string{
+	"pure": purePrimitives,
+	"safe": safePrimitives,
+	"full": primitiveNames(DefaultEnvironment),
+}
+
+// Profiles returns the names of the primitives in each profile accepted by ProfileEnvironment.
+// The result is a copy, which may be changed by the caller.
+func Profiles() map[string][]string {
+	result := make(map[string][]string, len(profiles))
+	for name, names := range profiles {
+		result[name] = append([]string{}, names...)
+	}
+	return result
+}
+
+// NewEnvironment returns an environment containing only the primitives of DefaultEnvironment named in `names`.
+func NewEnvironment(names ...string) (*Environ, error) {
+	env := NewEnviron()
+	for _, name := range names {
+		value, found := DefaultEnvironment.Get(Symbol(name))
+		if !found {
+			return nil, fmt.Errorf("unknown primitive: %s", name)
+		}
+		env = env.Put(Symbol(name), value)
+	}
+	return env, nil
+}
+
+// ProfileEnvironment returns the environment containing the primitives of the profile named `profile`.
+func ProfileEnvironment(profile string) (*Environ, error) {
+	names, ok := profiles[profile]
+	if !ok {
+		known := []string{}
+		for name := range profiles {
+			known = append(known, name)
+		}
+		sort.Strings(known)
+		return nil, fmt.Errorf("unknown profile %q, expected one of %s", profile, strings.Join(known, ", "))
+	}
+	return NewEnvironment(names...)
+}
+
+// primitiveNames returns the names bound in `env`, oldest first
+func primitiveNames(env *Environ) []string {
+	names := []string{}
+	for cur := env.Value; !IsNull(cur); cur = Cdr(cur) {
+		names = append([]string{string(Caar(cur).(Symbol))}, names...)
+	}
+	return names
+}
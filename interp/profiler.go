@@ -0,0 +1,262 @@
+package interp
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	. "github.com/zfjagann/gamma/sexpr"
+)
+
+/*
+Profiler samples the procedures being called by an interpreter. It is attached with WithProfiler.
+
+Every period, each thread of a running evaluation records the closures it is evaluating, and the primitive it is running, if any.
+A thread records its sample when it next takes a step, so the time spent blocked in a primitive such as sleep
+or channel-receive is attributed to that primitive. Tail calls replace the frame of their caller, so they are not sampled.
+
+The profile can be written in the format read by `go tool pprof` with WriteProfile,
+or summarized with the number of calls and the time spent in each procedure with WriteReport.
+*/
+type Profiler struct {
+	period time.Duration
+	ticks  int64 // the number of periods elapsed since Start
+	stop   chan struct{}
+	done   chan struct{}
+
+	mu        sync.Mutex
+	start     time.Time
+	duration  time.Duration
+	funcOrder []profileFunc             // the functions in the order they were first seen
+	funcs     map[profileFunc]int       // the index of each function in `funcOrder`
+	calls     map[int]int64             // the number of calls of each function
+	samples   map[string]*profileSample // samples with the same stack, keyed by the indexes of its functions
+}
+
+// profileFunc identifies a procedure in a profile
+type profileFunc struct {
+	Name string
+	File string
+	Line int
+}
+
+func (f profileFunc) String() string {
+	if f.Line == 0 {
+		return f.Name
+	}
+	if f.File == "" {
+		return fmt.Sprintf("%s (line %d)", f.Name, f.Line)
+	}
+	return fmt.Sprintf("%s (%s:%d)", f.Name, f.File, f.Line)
+}
+
+type profileSample struct {
+	stack []int // the functions of the stack, innermost first
+	count int64
+}
+
+// NewProfiler returns a profiler which samples every `period`. It does not sample until it is started.
+func NewProfiler(period time.Duration) *Profiler {
+	return &Profiler{
+		period:  period,
+		funcs:   map[profileFunc]int{},
+		calls:   map[int]int64{},
+		samples: map[string]*profileSample{},
+	}
+}
+
+// WithProfiler makes the interpreter record its calls and samples in `p`.
+func WithProfiler(p *Profiler) Option {
+	return func(in *Interpreter) {
+		in.profiler = p
+	}
+}
+
+// Start starts sampling.
+func (p *Profiler) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.start = time.Now()
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.tick(p.stop, p.done)
+}
+
+// Stop stops sampling. Samples which have not yet been recorded by their thread are lost.
+func (p *Profiler) Stop() {
+	close(p.stop)
+	<-p.done
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.duration = time.Since(p.start)
+}
+
+func (p *Profiler) tick(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(p.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			atomic.AddInt64(&p.ticks, 1)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// now returns the current tick, which a thread compares to its last tick to find if it is due to record a sample
+func (p *Profiler) now() int64 {
+	return atomic.LoadInt64(&p.ticks)
+}
+
+// funcOf returns the index of the function of `proc`. The caller must hold `mu`.
+func (p *Profiler) funcOf(proc SExpr) int {
+	var f profileFunc
+	switch proc := proc.(type) {
+	case *Closure:
+		f.Name = "lambda"
+		if proc.Name != nil {
+			f.Name = proc.Name.String()
+		}
+		if pos := PosOf(proc.Body); pos != nil {
+			f.File, f.Line = pos.File, pos.Line
+		}
+	case builtin:
+		f.Name = string(proc.Invariant)
+	case Invariant:
+		f.Name = string(proc)
+	default:
+		f.Name = proc.String()
+	}
+	i, ok := p.funcs[f]
+	if !ok {
+		i = len(p.funcOrder)
+		p.funcs[f] = i
+		p.funcOrder = append(p.funcOrder, f)
+	}
+	return i
+}
+
+// call records a call of the procedure `proc`
+func (p *Profiler) call(proc SExpr) {
+	switch proc.(type) {
+	case *Closure, builtin, Invariant:
+	default:
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls[p.funcOf(proc)]++
+}
+
+// sample records a sample of a thread with continuation `C`, which is running the primitive `primitive` if it is not nil,
+// if a period has passed since the last tick recorded by the thread.
+func (p *Profiler) sample(last *int64, primitive, C SExpr) {
+	now := p.now()
+	if now == *last {
+		return
+	}
+	count := now - *last
+	*last = now
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var stack []int
+	if primitive != nil {
+		stack = append(stack, p.funcOf(primitive))
+	}
+	for _, frame := range backtrace(C) {
+		stack = append(stack, p.funcOf(frame.Proc))
+	}
+	key := fmt.Sprint(stack)
+	s, ok := p.samples[key]
+	if !ok {
+		s = &profileSample{stack: stack}
+		p.samples[key] = s
+	}
+	s.count += count
+}
+
+type profileEntry struct {
+	fn                   profileFunc
+	calls                int64
+	exclusive, inclusive int64 // samples
+}
+
+// WriteReport writes the number of calls of each procedure, and the time spent in it excluding and including the procedures it called.
+// Times are estimated from the samples, so procedures which run for less than the period may not appear.
+func (p *Profiler) WriteReport(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entries := make([]profileEntry, len(p.funcOrder))
+	var total int64
+	for i, f := range p.funcOrder {
+		entries[i] = profileEntry{fn: f, calls: p.calls[i]}
+	}
+	for _, s := range p.samples {
+		total += s.count
+		if len(s.stack) > 0 {
+			entries[s.stack[0]].exclusive += s.count
+		}
+		seen := map[int]bool{}
+		for _, i := range s.stack {
+			if !seen[i] {
+				// recursive procedures are counted once per sample
+				seen[i] = true
+				entries[i].inclusive += s.count
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].exclusive != entries[j].exclusive {
+			return entries[i].exclusive > entries[j].exclusive
+		}
+		if entries[i].inclusive != entries[j].inclusive {
+			return entries[i].inclusive > entries[j].inclusive
+		}
+		return entries[i].calls > entries[j].calls
+	})
+
+	percent := func(n int64) string {
+		if total == 0 {
+			return "0.0%"
+		}
+		return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "calls\texclusive\t\tinclusive\t\t\n")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%d\t%v\t%s\t%v\t%s\t  %s\n",
+			e.calls, time.Duration(e.exclusive)*p.period, percent(e.exclusive),
+			time.Duration(e.inclusive)*p.period, percent(e.inclusive), e.fn)
+	}
+	fmt.Fprintf(tw, "\t%v\t\t\t\t  total\n", time.Duration(total)*p.period)
+	return tw.Flush()
+}
+
+// WriteProfile writes the samples in the gzipped protocol buffer format read by `go tool pprof`.
+func (p *Profiler) WriteProfile(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys := []string{}
+	for key := range p.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	samples := []*profileSample{}
+	for _, key := range keys {
+		samples = append(samples, p.samples[key])
+	}
+	return writePprof(w, pprofProfile{
+		funcs:    p.funcOrder,
+		samples:  samples,
+		period:   p.period,
+		start:    p.start,
+		duration: p.duration,
+	})
+}
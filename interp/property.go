@@ -0,0 +1,465 @@
+package interp
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	. "github.com/zfjagann/gamma/sexpr"
+)
+
+var checkPropertyLiteral SExpr = Symbol("check-property")
+
+const (
+	// the number of cases checked by check-property if it is not given
+	defaultPropertyCases = 100
+	// the size of the values generated for the last case. Sizes grow linearly from 0.
+	maxPropertySize = 50
+	// the number of failing cases tried while shrinking a counterexample
+	maxShrinks = 1000
+)
+
+/*
+Gen generates random values for check-property, and shrinks values it generated to simpler values.
+
+`size` bounds the values generated: integers are between -size and size, and lists have at most size elements.
+Shrinking returns simpler values than `v`, the simplest first.
+*/
+type Gen struct {
+	name     string
+	generate func(r *rand.Rand, size int) SExpr
+	shrink   func(v SExpr) []SExpr
+}
+
+func (g *Gen) String() string {
+	return fmt.Sprintf("<gen %s>", g.name)
+}
+
+// shrinkInteger returns the integers between `target` and `v`, starting with `target` and halving the distance to `v`
+func shrinkInteger(v, target int64) []SExpr {
+	// the distance is unsigned, as it may not fit in an int64
+	below := v < target
+	dist := uint64(v) - uint64(target)
+	if below {
+		dist = uint64(target) - uint64(v)
+	}
+	var result []SExpr
+	for d := dist; d != 0; d /= 2 {
+		if below {
+			result = append(result, Integer(uint64(v)+d))
+		} else {
+			result = append(result, Integer(uint64(v)-d))
+		}
+	}
+	return result
+}
+
+func integerGen(bounded bool, lo, hi int64) *Gen {
+	// integers shrink towards 0, or the bound closest to 0
+	target := int64(0)
+	if bounded && lo > 0 {
+		target = lo
+	} else if bounded && hi < 0 {
+		target = hi
+	}
+	return &Gen{
+		name: "integer",
+		generate: func(r *rand.Rand, size int) SExpr {
+			if bounded {
+				// the span is unsigned, as it may not fit in an int64
+				span := uint64(hi) - uint64(lo)
+				if span == math.MaxUint64 {
+					return Integer(r.Uint64())
+				}
+				return Integer(uint64(lo) + r.Uint64()%(span+1))
+			}
+			return Integer(r.Int63n(2*int64(size)+1) - int64(size))
+		},
+		shrink: func(v SExpr) []SExpr {
+			return shrinkInteger(int64(v.(Integer)), target)
+		},
+	}
+}
+
+var floatGen = &Gen{
+	name: "float",
+	generate: func(r *rand.Rand, size int) SExpr {
+		return Float((r.Float64()*2 - 1) * float64(size))
+	},
+	shrink: func(v SExpr) []SExpr {
+		f := float64(v.(Float))
+		var result []SExpr
+		if f != 0 {
+			result = append(result, Float(0))
+		}
+		if t := math.Trunc(f); t != f && t != 0 {
+			result = append(result, Float(t))
+		}
+		if math.Abs(f) >= 1 {
+			result = append(result, Float(f/2))
+		}
+		return result
+	},
+}
+
+var symbolGen = &Gen{
+	name: "symbol",
+	generate: func(r *rand.Rand, size int) SExpr {
+		n := 1 + r.Intn(1+size/8)
+		name := make([]byte, n)
+		for i := range name {
+			name[i] = byte('a' + r.Intn(26))
+		}
+		return Symbol(name)
+	},
+	shrink: func(v SExpr) []SExpr {
+		name := string(v.(Symbol))
+		var result []SExpr
+		if name != "a" {
+			result = append(result, Symbol("a"))
+		}
+		if len(name) > 1 {
+			result = append(result, Symbol(name[:len(name)/2]), Symbol(name[:len(name)-1]))
+		}
+		return result
+	},
+}
+
+var booleanGen = &Gen{
+	name: "boolean",
+	generate: func(r *rand.Rand, size int) SExpr {
+		return Boolean(r.Intn(2) == 0)
+	},
+	shrink: func(v SExpr) []SExpr {
+		if v == True {
+			return []SExpr{False}
+		}
+		return nil
+	},
+}
+
+// shrinkList returns simpler lists than `items`: the empty list, lists with elements removed,
+// and lists with one element shrunk by `shrink`
+func shrinkList(items []SExpr, shrink func(SExpr) []SExpr) []SExpr {
+	if len(items) == 0 {
+		return nil
+	}
+	result := []SExpr{Null}
+	without := func(from, to int) SExpr {
+		return List(append(append([]SExpr{}, items[:from]...), items[to:]...)...)
+	}
+	if half := len(items) / 2; half > 0 {
+		result = append(result, without(0, half), without(half, len(items)))
+	}
+	for i := range items {
+		result = append(result, without(i, i+1))
+	}
+	for i, item := range items {
+		for _, smaller := range shrink(item) {
+			replaced := append([]SExpr{}, items...)
+			replaced[i] = smaller
+			result = append(result, List(replaced...))
+		}
+	}
+	return result
+}
+
+func listGen(elem *Gen) *Gen {
+	return &Gen{
+		name: "list",
+		generate: func(r *rand.Rand, size int) SExpr {
+			items := make([]SExpr, r.Intn(size+1))
+			for i := range items {
+				items[i] = elem.generate(r, size)
+			}
+			return List(items...)
+		},
+		shrink: func(v SExpr) []SExpr {
+			items, _ := listToSlice(nil, v)
+			return shrinkList(items, elem.shrink)
+		},
+	}
+}
+
+func oneOfGen(values []SExpr) *Gen {
+	return &Gen{
+		name: "one-of",
+		generate: func(r *rand.Rand, size int) SExpr {
+			return values[r.Intn(len(values))]
+		},
+		shrink: func(v SExpr) []SExpr {
+			// values shrink to the values before them
+			for i, value := range values {
+				if IsEqStar(value, v) {
+					return values[:i]
+				}
+			}
+			return nil
+		},
+	}
+}
+
+var sexprAtomGens = []*Gen{integerGen(false, 0, 0), symbolGen, booleanGen, oneOfGen([]SExpr{Null})}
+
+var sexprGen *Gen
+
+func init() {
+	// sexprGen refers to itself
+	sexprGen = &Gen{
+		name: "sexpr",
+		generate: func(r *rand.Rand, size int) SExpr {
+			if size <= 1 || r.Intn(3) == 0 {
+				return sexprAtomGens[r.Intn(len(sexprAtomGens))].generate(r, size)
+			}
+			items := make([]SExpr, r.Intn(5))
+			for i := range items {
+				items[i] = sexprGen.generate(r, size/2)
+			}
+			return List(items...)
+		},
+		shrink: func(v SExpr) []SExpr {
+			switch v := v.(type) {
+			case Integer:
+				return shrinkInteger(int64(v), 0)
+			case Symbol:
+				return symbolGen.shrink(v)
+			case Boolean:
+				return booleanGen.shrink(v)
+			case *Pair:
+				items, err := listToSlice(nil, v)
+				if err != nil {
+					return []SExpr{Null}
+				}
+				// a list also shrinks to its elements
+				return append(shrinkList(items, sexprGen.shrink), items...)
+			}
+			return nil
+		},
+	}
+}
+
+// makeGen returns the generator made by the primitive `name` with the arguments `randList`
+func makeGen(name string, rator, randList SExpr) (SExpr, error) {
+	switch name {
+	case "gen-integer":
+		if IsNull(randList) {
+			return integerGen(false, 0, 0), nil
+		}
+		if err := checkLen(2, rator, randList); err != nil {
+			return nil, err
+		}
+		lo, ok := Car(randList).(Integer)
+		if !ok {
+			return nil, &TypeError{Proc: rator, Expected: "an integer", Value: Car(randList)}
+		}
+		hi, ok := Cadr(randList).(Integer)
+		if !ok {
+			return nil, &TypeError{Proc: rator, Expected: "an integer", Value: Cadr(randList)}
+		}
+		if hi < lo {
+			return nil, runtimeErrorf("gen-integer expects an upper bound which is not less than the lower bound: %v %v", lo, hi)
+		}
+		return integerGen(true, int64(lo), int64(hi)), nil
+	case "gen-list":
+		if err := checkLen(1, rator, randList); err != nil {
+			return nil, err
+		}
+		elem, ok := Car(randList).(*Gen)
+		if !ok {
+			return nil, &TypeError{Proc: rator, Expected: "a generator", Value: Car(randList)}
+		}
+		return listGen(elem), nil
+	case "gen-one-of":
+		values, err := listToSlice(rator, randList)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			return nil, &ArityError{Proc: rator, Expected: 1, Variadic: true}
+		}
+		return oneOfGen(values), nil
+	}
+
+	if err := checkLen(0, rator, randList); err != nil {
+		return nil, err
+	}
+	switch name {
+	case "gen-float":
+		return floatGen, nil
+	case "gen-symbol":
+		return symbolGen, nil
+	case "gen-boolean":
+		return booleanGen, nil
+	default:
+		return sexprGen, nil
+	}
+}
+
+// genSample returns a value generated by the generator in `randList`, with the size given after it or 10.
+// The size is at most maxPropertySize, the largest size used by check-property.
+func genSample(rator, randList SExpr) (SExpr, error) {
+	if randLength(randList) != 1 {
+		if err := checkLen(2, rator, randList); err != nil {
+			return nil, err
+		}
+	}
+	g, ok := Car(randList).(*Gen)
+	if !ok {
+		return nil, &TypeError{Proc: rator, Expected: "a generator", Value: Car(randList)}
+	}
+	size := Integer(10)
+	if !IsNull(Cdr(randList)) {
+		if size, ok = Cadr(randList).(Integer); !ok || size < 0 || size > maxPropertySize {
+			return nil, &TypeError{Proc: rator, Expected: fmt.Sprintf("a size between 0 and %d", maxPropertySize), Value: Cadr(randList)}
+		}
+	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return g.generate(r, int(size)), nil
+}
+
+// propertyApplication translates a check-property form into an application of the built-in of the same name
+//
+//	(check-property [NAME [CASES]] ((VAR GEN)...) BODY)
+//
+// becomes
+//
+//	('check-property 'FORM NAME CASES '(VAR...) ('cons GEN ... '()) (lambda (VAR...) BODY))
+//
+// where FORM is the check-property form. If the property has no name, NAME is #f, and if it has no number of cases, CASES is #f.
+func propertyApplication(expr SExpr) (SExpr, error) {
+	args, err := listToSlice(nil, Cdr(expr))
+	if err != nil || len(args) < 2 || len(args) > 4 {
+		return nil, syntaxErrorf(expr, "invalid check-property: %v", expr)
+	}
+	var name, cases SExpr = False, False
+	if len(args) > 2 {
+		name = args[0]
+	}
+	if len(args) > 3 {
+		cases = args[1]
+	}
+	bindings, body := args[len(args)-2], args[len(args)-1]
+
+	vars := []SExpr{}
+	var gens SExpr = Quote(Null)
+	items, err := listToSlice(nil, bindings)
+	if err != nil {
+		return nil, syntaxErrorf(expr, "invalid check-property bindings: %v", bindings)
+	}
+	for i := len(items) - 1; i >= 0; i-- {
+		if randLength(items[i]) != 2 || !IsSymbol(Car(items[i])) {
+			return nil, syntaxErrorf(items[i], "invalid check-property binding: %v", items[i])
+		}
+		vars = append([]SExpr{Car(items[i])}, vars...)
+		gens = List(Quote(Invariant("cons")), Cadr(items[i]), gens)
+	}
+	return List(Quote(Invariant("check-property")), Quote(expr), name, cases, Quote(List(vars...)), gens,
+		List(lambdaLiteral, List(vars...), body)), nil
+}
+
+// falsifies applies the property `prop` to `args`, and returns a description of the failure,
+// or "" if the property holds. Only fatal errors are returned.
+func (in *Interpreter) falsifies(ctx context.Context, stack *interpStack, prop SExpr, args []SExpr) (string, error) {
+	value, err := in.apply(ctx, stack, prop, List(args...))
+	if err != nil {
+		if isFatal(err) {
+			return "", err
+		}
+		return err.Error(), nil
+	}
+	if value == False {
+		return "#f", nil
+	}
+	return "", nil
+}
+
+// checkProperty runs the property with the arguments made by propertyApplication, and records its result.
+// The first failing case is shrunk by trying simpler values for each variable until no simpler value fails.
+func (in *Interpreter) checkProperty(ctx context.Context, stack *interpStack, randList SExpr) error {
+	args, _ := listToSlice(nil, randList)
+	form, name, casesArg, vars, gensArg, prop := args[0], args[1], args[2], args[3], args[4], args[5]
+
+	result := TestResult{Name: testName(name), Pos: PosOf(form)}
+	if name == False {
+		result.Name = abbreviate(form.String())
+	}
+	cases := defaultPropertyCases
+	if casesArg != False {
+		n, ok := casesArg.(Integer)
+		if !ok || n < 1 {
+			return &TypeError{Proc: checkPropertyLiteral, Expected: "a positive number of cases", Value: casesArg}
+		}
+		cases = int(n)
+	}
+	gens := []*Gen{}
+	values, _ := listToSlice(nil, gensArg)
+	for _, value := range values {
+		g, ok := value.(*Gen)
+		if !ok {
+			return &TypeError{Proc: checkPropertyLiteral, Expected: "a generator", Value: value}
+		}
+		gens = append(gens, g)
+	}
+
+	seed := in.tests.propertySeed()
+	r := rand.New(rand.NewSource(seed))
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+		in.tests.record(result)
+	}()
+
+	for i := 0; i < cases; i++ {
+		size := i * maxPropertySize / cases
+		inputs := make([]SExpr, len(gens))
+		for j, g := range gens {
+			inputs[j] = g.generate(r, size)
+			budgetFromContext(ctx).allocValue(inputs[j])
+		}
+		failure, err := in.falsifies(ctx, stack, prop, inputs)
+		if err != nil {
+			return err
+		}
+		if failure == "" {
+			continue
+		}
+
+		shrinks := 0
+		for steps, improved := 0, true; improved && steps < maxShrinks; {
+			improved = false
+			for j := 0; j < len(gens) && !improved && steps < maxShrinks; j++ {
+				for _, smaller := range gens[j].shrink(inputs[j]) {
+					trial := append([]SExpr{}, inputs...)
+					trial[j] = smaller
+					steps++
+					f, err := in.falsifies(ctx, stack, prop, trial)
+					if err != nil {
+						return err
+					}
+					if f != "" {
+						inputs, failure, improved = trial, f, true
+						shrinks++
+						break
+					}
+					if steps >= maxShrinks {
+						break
+					}
+				}
+			}
+		}
+
+		bindings := []string{}
+		names, _ := listToSlice(nil, vars)
+		for j, input := range inputs {
+			bindings = append(bindings, fmt.Sprintf("(%v %v)", names[j], input))
+		}
+		result.Message = fmt.Sprintf("falsified after %d cases by %s: %s (seed %d, shrunk %d times)",
+			i+1, strings.Join(bindings, " "), failure, seed, shrinks)
+		return nil
+	}
+	result.Passed = true
+	return nil
+}
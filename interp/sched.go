@@ -0,0 +1,210 @@
+package interp
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var Deadlock error = fmt.Errorf("deadlock: all threads are blocked")
+
+/*
+Type scheduler runs threads one at a time in a reproducible order.
+
+Every thread runs in its own goroutine, but only the thread holding the baton may evaluate.
+At every continuation application the running thread passes the baton to a thread chosen by
+the random number generator, so the interleaving of threads depends only on the seed.
+
+Threads never block while holding the baton. Instead, a thread that is waiting for another thread
+stalls, passing the baton on until it is able to continue. Timeouts expire once every thread has stalled,
+as no thread would be able to make progress without them.
+*/
+type scheduler struct {
+	mu       sync.Mutex
+	rand     *rand.Rand
+	running  *thread
+	runnable []*thread // threads waiting for the baton, excluding the running thread
+	live     int       // the number of threads which have not exited
+	stalled  int       // the number of consecutive turns in which no thread made progress
+}
+
+type thread struct {
+	wake chan struct{}
+}
+
+type threadKey struct{}
+
+// WithDeterministicScheduler runs all pexec and spawn threads on a single scheduler which interleaves them
+// according to `seed`. Running the same program with the same seed produces the same interleaving.
+func WithDeterministicScheduler(seed int64) Option {
+	return func(in *Interpreter) {
+		in.sched = &scheduler{rand: rand.New(rand.NewSource(seed))}
+	}
+}
+
+func threadFromContext(ctx context.Context) *thread {
+	t, _ := ctx.Value(threadKey{}).(*thread)
+	return t
+}
+
+// enter adds the calling goroutine as a new thread, and waits for it to receive the baton.
+func (s *scheduler) enter() *thread {
+	t := &thread{make(chan struct{}, 1)}
+	s.mu.Lock()
+	s.live++
+	if s.running == nil {
+		s.running = t
+		s.mu.Unlock()
+		return t
+	}
+	s.runnable = append(s.runnable, t)
+	s.mu.Unlock()
+	<-t.wake
+	return t
+}
+
+// start adds a new thread, which should wait for `t.wake` before evaluating.
+func (s *scheduler) start() *thread {
+	t := &thread{make(chan struct{}, 1)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.live++
+	if s.running == nil {
+		s.running = t
+		t.wake <- struct{}{}
+	} else {
+		s.runnable = append(s.runnable, t)
+	}
+	return t
+}
+
+// exit removes the running thread `t`, passing the baton to another thread.
+func (s *scheduler) exit(t *thread) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.live--
+	s.stalled = 0
+	if len(s.runnable) == 0 {
+		s.running = nil
+		return
+	}
+	next := s.take(s.rand.Intn(len(s.runnable)))
+	s.running = next
+	next.wake <- struct{}{}
+}
+
+// yield is called by the running thread `t` after making progress. It may pass the baton to another thread.
+func (s *scheduler) yield(t *thread) {
+	s.mu.Lock()
+	s.stalled = 0
+	if len(s.runnable) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	i := s.rand.Intn(len(s.runnable) + 1)
+	if i == len(s.runnable) {
+		s.mu.Unlock()
+		return
+	}
+	s.switchTo(t, s.take(i))
+}
+
+// stall is called by the running thread `t` when it is unable to make progress.
+// It passes the baton to the thread which has waited longest. If every thread has stalled,
+// stall reports that the timeout of `t` has expired, or fails with Deadlock if `t` has no timeout.
+func (s *scheduler) stall(ctx context.Context, t *thread, timeout bool) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	s.stalled++
+	if s.stalled > s.live || len(s.runnable) == 0 {
+		if timeout {
+			s.stalled = 0
+			s.mu.Unlock()
+			return true, nil
+		} else if s.stalled > 2*s.live || len(s.runnable) == 0 {
+			// every thread with a timeout has had a chance to expire
+			s.mu.Unlock()
+			return false, Deadlock
+		}
+	}
+	s.switchTo(t, s.take(0))
+	return false, nil
+}
+
+// switchTo passes the baton from `t` to `next` and waits for it to come back. `s.mu` must be locked.
+func (s *scheduler) switchTo(t, next *thread) {
+	s.runnable = append(s.runnable, t)
+	s.running = next
+	s.mu.Unlock()
+	next.wake <- struct{}{}
+	<-t.wake
+}
+
+// take removes the i'th runnable thread. `s.mu` must be locked.
+func (s *scheduler) take(i int) *thread {
+	t := s.runnable[i]
+	s.runnable = append(s.runnable[:i:i], s.runnable[i+1:]...)
+	return t
+}
+
+/**
+*** Blocking
+**/
+
+// selectCases waits until one of `cases` can proceed, like reflect.Select.
+// If `timeout` is not negative and expires first, the chosen index is -1.
+// Under the deterministic scheduler, the thread stalls instead of blocking, and the first case
+// which is ready is chosen, rather than a random one.
+func (in *Interpreter) selectCases(ctx context.Context, cases []reflect.SelectCase, timeout time.Duration) (int, reflect.Value, bool, error) {
+	n := len(cases)
+	if t := threadFromContext(ctx); in.sched != nil && t != nil {
+		for {
+			if chosen, recv, recvOK := probeCases(cases); chosen >= 0 {
+				return chosen, recv, recvOK, nil
+			}
+			expired, err := in.sched.stall(ctx, t, timeout >= 0)
+			if err != nil {
+				return -1, reflect.Value{}, false, err
+			} else if expired {
+				return -1, reflect.Value{}, false, nil
+			}
+		}
+	}
+
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())})
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)})
+	}
+	chosen, recv, recvOK := reflect.Select(cases)
+	if chosen == n {
+		return -1, reflect.Value{}, false, ctx.Err()
+	} else if chosen > n {
+		return -1, reflect.Value{}, false, nil
+	}
+	return chosen, recv, recvOK, nil
+}
+
+// probeCases tries each of `cases` in order without blocking, returning the index of the first one
+// which proceeds, or -1 if none are ready.
+func probeCases(cases []reflect.SelectCase) (int, reflect.Value, bool) {
+	probe := []reflect.SelectCase{{}, {Dir: reflect.SelectDefault}}
+	for i, c := range cases {
+		probe[0] = c
+		if chosen, recv, recvOK := reflect.Select(probe); chosen == 0 {
+			return i, recv, recvOK
+		}
+	}
+	return -1, reflect.Value{}, false
+}
+
+// recvCase returns a select case which receives from `ch`
+func recvCase(ch interface{}) reflect.SelectCase {
+	return reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)}
+}
@@ -0,0 +1,241 @@
+package interp
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	. "github.com/zfjagann/gamma/sexpr"
+)
+
+/**
+*** Mutex
+**/
+
+// Mutex is a lock which can be held by one thread at a time.
+type Mutex struct {
+	ch chan struct{}
+}
+
+func newMutex() *Mutex {
+	return &Mutex{make(chan struct{}, 1)}
+}
+
+func (*Mutex) String() string {
+	return "<mutex>"
+}
+
+// lockMutex acquires `m`, giving up if `ctx` is cancelled first.
+func (in *Interpreter) lockMutex(ctx context.Context, m *Mutex) error {
+	_, _, _, err := in.selectCases(ctx, []reflect.SelectCase{{
+		Dir:  reflect.SelectSend,
+		Chan: reflect.ValueOf(m.ch),
+		Send: reflect.ValueOf(struct{}{}),
+	}}, -1)
+	return err
+}
+
+func (m *Mutex) unlock() {
+	<-m.ch
+}
+
+// mutexHold is an entry into a with-mutex block. The mutex is released once, when the block returns,
+// when a continuation escapes from the block, or when the evaluation fails.
+// Re-entering the block through a continuation after that does not release it again.
+type mutexHold struct {
+	m     *Mutex
+	once  sync.Once
+	depth int // the depth of the C12 continuation of the block
+}
+
+func (*mutexHold) String() string {
+	return "<mutex hold>"
+}
+
+func (h *mutexHold) release() {
+	h.once.Do(h.m.unlock)
+}
+
+// within reports whether the continuation `C` is inside the with-mutex block of `h`
+func (h *mutexHold) within(C SExpr) bool {
+	c := frameAt(C, h.depth)
+	return c != nil && c.id == "c12" && c.Answer == SExpr(h)
+}
+
+func toMutex(rator, e SExpr) (*Mutex, error) {
+	m, ok := e.(*Mutex)
+	if !ok {
+		return nil, &TypeError{Proc: rator, Expected: "a mutex", Value: e}
+	}
+	return m, nil
+}
+
+/**
+*** Atomic
+**/
+
+// Atomic is a box holding a single value which can be updated atomically.
+type Atomic struct {
+	mu    sync.Mutex
+	value SExpr
+}
+
+func (*Atomic) String() string {
+	return "<atomic>"
+}
+
+func (a *Atomic) get() SExpr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.value
+}
+
+// compareAndSet sets the value to `new` if it is currently `old`.
+func (a *Atomic) compareAndSet(old, new SExpr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !identical(a.value, old) {
+		return false
+	}
+	a.value = new
+	return true
+}
+
+func toAtomic(rator, e SExpr) (*Atomic, error) {
+	a, ok := e.(*Atomic)
+	if !ok {
+		return nil, &TypeError{Proc: rator, Expected: "an atomic", Value: e}
+	}
+	return a, nil
+}
+
+// identical reports whether `a` and `b` are eq?, or are the same object.
+func identical(a, b SExpr) bool {
+	if IsEq(a, b) {
+		return true
+	}
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	return va.Kind() == reflect.Ptr && va.Type() == vb.Type() && va.Pointer() == vb.Pointer()
+}
+
+/**
+*** Software Transactional Memory
+**/
+
+// TVar is a transactional variable. It can only be modified inside `atomically`.
+type TVar struct {
+	version uint64
+	value   SExpr
+}
+
+func (*TVar) String() string {
+	return "<tvar>"
+}
+
+func toTVar(rator, e SExpr) (*TVar, error) {
+	tv, ok := e.(*TVar)
+	if !ok {
+		return nil, &TypeError{Proc: rator, Expected: "a tvar", Value: e}
+	}
+	return tv, nil
+}
+
+// All TVars are protected by a single lock.
+// `changed` is closed and replaced whenever a transaction commits.
+var stm = struct {
+	sync.Mutex
+	changed chan struct{}
+}{changed: make(chan struct{})}
+
+// transaction records the TVars read and written by an `atomically` block.
+type transaction struct {
+	// The thunk passed to atomically, and the continuation of the atomically block,
+	// used to restart the transaction.
+	thunk SExpr
+	C     SExpr
+
+	reads  map[*TVar]uint64
+	writes map[*TVar]SExpr
+}
+
+func newTransaction(thunk, C SExpr) *transaction {
+	return &transaction{
+		thunk:  thunk,
+		C:      C,
+		reads:  make(map[*TVar]uint64),
+		writes: make(map[*TVar]SExpr),
+	}
+}
+
+// within reports whether the continuation `C` is inside the atomically block of `tx`
+func (tx *transaction) within(C SExpr) bool {
+	c := frameAt(C, depthOf(tx.C)+1)
+	return c != nil && c.id == "c14"
+}
+
+func (tx *transaction) read(tv *TVar) SExpr {
+	if value, ok := tx.writes[tv]; ok {
+		return value
+	}
+	stm.Lock()
+	defer stm.Unlock()
+	if _, ok := tx.reads[tv]; !ok {
+		tx.reads[tv] = tv.version
+	}
+	return tv.value
+}
+
+func (tx *transaction) write(tv *TVar, value SExpr) {
+	tx.writes[tv] = value
+}
+
+// valid reports whether none of the TVars read by the transaction have changed. `stm` must be locked.
+func (tx *transaction) valid() bool {
+	for tv, version := range tx.reads {
+		if tv.version != version {
+			return false
+		}
+	}
+	return true
+}
+
+// commit applies the writes of the transaction, unless another transaction has modified the TVars it read.
+func (tx *transaction) commit() bool {
+	stm.Lock()
+	defer stm.Unlock()
+	if !tx.valid() {
+		return false
+	}
+	if len(tx.writes) == 0 {
+		return true
+	}
+	for tv, value := range tx.writes {
+		tv.value = value
+		tv.version++
+	}
+	close(stm.changed)
+	stm.changed = make(chan struct{})
+	return true
+}
+
+// waitTransaction waits until one of the TVars read by `tx` is modified.
+func (in *Interpreter) waitTransaction(ctx context.Context, tx *transaction) error {
+	for {
+		stm.Lock()
+		valid := tx.valid()
+		changed := stm.changed
+		stm.Unlock()
+		if !valid {
+			return nil
+		}
+		if _, _, _, err := in.selectCases(ctx, []reflect.SelectCase{recvCase(changed)}, -1); err != nil {
+			return err
+		}
+	}
+}
+
+func readTVar(tv *TVar) SExpr {
+	stm.Lock()
+	defer stm.Unlock()
+	return tv.value
+}
@@ -0,0 +1,252 @@
+package interp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/zfjagann/gamma/sexpr"
+)
+
+var (
+	testEqualLiteral  SExpr = Symbol("test-equal")
+	testAssertLiteral SExpr = Symbol("test-assert")
+	testErrorLiteral  SExpr = Symbol("test-error")
+)
+
+// TestResult is the outcome of a test-equal, test-assert or test-error form.
+type TestResult struct {
+	Group    string    // the names of the enclosing test-begin groups, separated by "/"
+	Name     string    // the name of the test, or its source if it has no name
+	Pos      *Position // the location of the test, or nil if it is not known
+	Passed   bool
+	Message  string // why the test failed
+	Duration time.Duration
+}
+
+func (r TestResult) String() string {
+	name := r.Name
+	if r.Group != "" {
+		name = r.Group + "/" + name
+	}
+	if r.Pos != nil {
+		name += " at " + r.Pos.String()
+	}
+	if r.Passed {
+		return "PASS " + name
+	}
+	return "FAIL " + name + ": " + r.Message
+}
+
+/*
+TestRunner records the results of the tests run by an interpreter. It is set with WithTestRunner.
+By default, each interpreter has a runner which writes to standard output.
+
+If the runner has an output, it writes each failed test as it fails,
+and the number of tests which passed and failed when the outermost group ends.
+*/
+type TestRunner struct {
+	mu      sync.Mutex
+	output  io.Writer
+	groups  []string
+	results []TestResult
+	counts  [2]int // the number of tests which failed and passed in the outermost group
+	seed    int64  // the seed of the random values of check-property, or 0 for a different seed each time
+}
+
+// NewTestRunner returns a runner which writes to `output`, or writes nothing if it is nil.
+func NewTestRunner(output io.Writer) *TestRunner {
+	return &TestRunner{output: output}
+}
+
+// WithTestRunner makes the interpreter record the results of its tests in `r`.
+func WithTestRunner(r *TestRunner) Option {
+	return func(in *Interpreter) {
+		in.tests = r
+	}
+}
+
+// Results returns the results of the tests run so far.
+func (r *TestRunner) Results() []TestResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]TestResult{}, r.results...)
+}
+
+// Failed returns the number of tests which failed.
+func (r *TestRunner) Failed() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	failed := 0
+	for _, result := range r.results {
+		if !result.Passed {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Groups returns the names of the groups which have been started with test-begin but not ended.
+func (r *TestRunner) Groups() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.groups...)
+}
+
+// SetSeed makes each check-property use the random values of `seed`, so that a failure can be reproduced.
+// A seed of 0 uses a different seed for each property.
+func (r *TestRunner) SetSeed(seed int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seed = seed
+}
+
+// propertySeed returns the seed for the next check-property
+func (r *TestRunner) propertySeed() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seed != 0 {
+		return r.seed
+	}
+	return time.Now().UnixNano()
+}
+
+// testName returns the name of a test or group given as the value `name`, usually a symbol
+func testName(name SExpr) string {
+	return name.String()
+}
+
+func (r *TestRunner) begin(name SExpr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.groups) == 0 {
+		r.counts = [2]int{}
+	}
+	r.groups = append(r.groups, testName(name))
+}
+
+func (r *TestRunner) end(rator, randList SExpr) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.groups) == 0 {
+		return runtimeErrorf("test-end without test-begin")
+	}
+	group := r.groups[len(r.groups)-1]
+	if !IsNull(randList) {
+		if err := checkLen(1, rator, randList); err != nil {
+			return err
+		}
+		if name := testName(Car(randList)); name != group {
+			return runtimeErrorf("test-end %s does not match test-begin %s", name, group)
+		}
+	}
+	r.groups = r.groups[:len(r.groups)-1]
+	if len(r.groups) == 0 && r.output != nil {
+		fmt.Fprintf(r.output, "%s: %d passed, %d failed\n", group, r.counts[1], r.counts[0])
+	}
+	return nil
+}
+
+func (r *TestRunner) record(result TestResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result.Group = strings.Join(r.groups, "/")
+	r.results = append(r.results, result)
+	if result.Passed {
+		r.counts[1]++
+	} else {
+		r.counts[0]++
+		if r.output != nil {
+			fmt.Fprintln(r.output, result)
+		}
+	}
+}
+
+// testApplication translates a test form into an application of the built-in of the same name
+//
+//	(test-equal [NAME] EXPECTED EXPR)
+//	(test-assert [NAME] EXPR)
+//	(test-error [NAME] EXPR)
+//
+// become
+//
+//	('test-equal 'FORM NAME (lambda () EXPECTED) (lambda () EXPR))
+//	('test-assert 'FORM NAME (lambda () EXPR))
+//	('test-error 'FORM NAME (lambda () EXPR))
+//
+// where FORM is the test form, which gives the location of the test. If the test has no name, NAME is #f.
+func testApplication(expr SExpr) (SExpr, error) {
+	args := 1
+	if IsEq(Car(expr), testEqualLiteral) {
+		args = 2
+	}
+	n := randLength(Cdr(expr))
+	if n != args && n != args+1 {
+		return nil, syntaxErrorf(expr, "invalid %v: %v", Car(expr), expr)
+	}
+	var name SExpr = False
+	exprs := Cdr(expr)
+	if n == args+1 {
+		name = Car(exprs)
+		exprs = Cdr(exprs)
+	}
+	result := []SExpr{Quote(expr), name}
+	for ; !IsNull(exprs); exprs = Cdr(exprs) {
+		result = append(result, List(lambdaLiteral, Null, Car(exprs)))
+	}
+	return Cons(Quote(Invariant(Car(expr).(Symbol))), List(result...)), nil
+}
+
+// isFatal reports whether `err` should stop the evaluation, rather than fail a test
+func isFatal(err error) bool {
+	return errors.Is(err, Exit) || errors.Is(err, Quit) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// runTest runs the test `kind` with the arguments made by testApplication, and records its result.
+func (in *Interpreter) runTest(ctx context.Context, stack *interpStack, kind string, randList SExpr) error {
+	form, name, thunks := Car(randList), Cadr(randList), Cddr(randList)
+	result := TestResult{Name: testName(name), Pos: PosOf(form)}
+	if name == False {
+		result.Name = abbreviate(form.String())
+	}
+
+	start := time.Now()
+	values := []SExpr{}
+	var err error
+	for cur := thunks; !IsNull(cur) && err == nil; cur = Cdr(cur) {
+		var value SExpr
+		value, err = in.apply(ctx, stack, Car(cur), Null)
+		values = append(values, value)
+	}
+	result.Duration = time.Since(start)
+	if err != nil && isFatal(err) {
+		return err
+	}
+
+	switch {
+	case kind == "test-error":
+		result.Passed = err != nil
+		if !result.Passed {
+			result.Message = fmt.Sprintf("expected an error but was %v", values[0])
+		}
+	case err != nil:
+		result.Message = err.Error()
+	case kind == "test-equal":
+		result.Passed = IsEqStar(values[0], values[1])
+		if !result.Passed {
+			result.Message = fmt.Sprintf("expected %v but was %v", values[0], values[1])
+		}
+	default:
+		result.Passed = !IsEq(values[0], False)
+		if !result.Passed {
+			result.Message = "assertion was #f"
+		}
+	}
+	in.tests.record(result)
+	return nil
+}
@@ -0,0 +1,164 @@
+package interp
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/zfjagann/gamma/sexpr"
+)
+
+/*
+Tracer is notified of the closure calls made by an interpreter. It is set with WithTracer.
+
+Enter is called when a closure is called, and Return when it returns `result`.
+A tail call replaces the frame of its caller, so a chain of tail calls has the same Depth and returns once,
+from the frame of the last call. Frames which are left by a continuation or an error do not return.
+Error is called once when an evaluation fails.
+
+The methods may be called from multiple goroutines at once, when the evaluation uses pexec or spawn.
+*/
+type Tracer interface {
+	Enter(frame *Frame)
+	Return(frame *Frame, result SExpr)
+	Error(err error)
+}
+
+// WithTracer makes the interpreter notify `t` of every closure call.
+func WithTracer(t Tracer) Option {
+	return func(in *Interpreter) {
+		in.tracer = t
+	}
+}
+
+// WithTraceOutput sets where the calls of closures traced with `trace` are printed. The default is standard output.
+func WithTraceOutput(w io.Writer) Option {
+	return func(in *Interpreter) {
+		in.traced.output = w
+	}
+}
+
+// callDepth returns the number of closures being evaluated in the continuation `C`
+func callDepth(C SExpr) int {
+	for {
+		c, ok := C.(interpContinuation)
+		if !ok {
+			return 0
+		}
+		if c.id == "c18" {
+			return c.Answer.(*Frame).Depth + 1
+		}
+		C = c.C
+	}
+}
+
+func (in *Interpreter) traceEnter(frame *Frame) {
+	if in.tracer != nil {
+		in.tracer.Enter(frame)
+	}
+	in.traced.Enter(frame)
+}
+
+func (in *Interpreter) traceReturn(frame *Frame, result SExpr) {
+	if in.tracer != nil {
+		in.tracer.Return(frame, result)
+	}
+	in.traced.Return(frame, result)
+}
+
+func (in *Interpreter) traceError(err error) {
+	if in.tracer != nil {
+		in.tracer.Error(err)
+	}
+	in.traced.Error(err)
+}
+
+// printTracer is the Tracer used by the `trace` and `untrace` primitives.
+// It prints the calls of the traced closures, indented by their depth.
+type printTracer struct {
+	count  int32 // the number of traced closures, so that nothing is locked while none are traced
+	mu     sync.Mutex
+	traced map[*Closure]bool
+	output io.Writer
+}
+
+func newPrintTracer(output io.Writer) *printTracer {
+	return &printTracer{traced: map[*Closure]bool{}, output: output}
+}
+
+// trace starts or stops tracing `closures`. Untracing no closures stops tracing every closure.
+func (t *printTracer) trace(closures []*Closure, on bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !on && len(closures) == 0 {
+		t.traced = map[*Closure]bool{}
+	}
+	for _, clos := range closures {
+		if on {
+			t.traced[clos] = true
+		} else {
+			delete(t.traced, clos)
+		}
+	}
+	atomic.StoreInt32(&t.count, int32(len(t.traced)))
+}
+
+// isTraced reports whether `frame` is a call to a traced closure. The caller must hold `mu`.
+func (t *printTracer) isTraced(frame *Frame) bool {
+	return t.traced[frame.Proc]
+}
+
+func (t *printTracer) Enter(frame *Frame) {
+	if atomic.LoadInt32(&t.count) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.isTraced(frame) {
+		fmt.Fprintf(t.output, "%s%v\n", strings.Repeat("| ", frame.Depth), frame)
+	}
+}
+
+func (t *printTracer) Return(frame *Frame, result SExpr) {
+	if atomic.LoadInt32(&t.count) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.isTraced(frame) {
+		fmt.Fprintf(t.output, "%s%v\n", strings.Repeat("| ", frame.Depth), result)
+	}
+}
+
+func (t *printTracer) Error(err error) {
+	if atomic.LoadInt32(&t.count) == 0 {
+		return
+	}
+	c := ContextOf(err)
+	if c == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, frame := range c.Backtrace {
+		if t.isTraced(frame) {
+			fmt.Fprintf(t.output, "%serror: %v\n", strings.Repeat("| ", frame.Depth), err)
+			return
+		}
+	}
+}
+
+// tracedClosures returns the closures in the arguments of `trace` or `untrace`
+func tracedClosures(rator SExpr, randList SExpr) ([]*Closure, error) {
+	var closures []*Closure
+	for cur := randList; IsPair(cur); cur = Cdr(cur) {
+		clos, ok := Car(cur).(*Closure)
+		if !ok {
+			return nil, &TypeError{Proc: rator, Expected: "a closure", Value: Car(cur)}
+		}
+		closures = append(closures, clos)
+	}
+	return closures, nil
+}
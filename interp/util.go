@@ -1,8 +1,6 @@
 package interp
 
 import (
-	"fmt"
-
 	. "github.com/zfjagann/gamma/sexpr"
 )
 
@@ -20,7 +18,26 @@ func randLength(randList SExpr) int {
 func checkLen(size int, rator, randList SExpr) error {
 	actual := randLength(randList)
 	if actual != size {
-		return fmt.Errorf("%v expects %d arguments but was given %d", rator, size, actual)
+		return &ArityError{Proc: rator, Expected: size, Actual: actual}
 	}
 	return nil
 }
+
+// arithmetic returns the built-in `name`, which applies `op` to its arguments after checking that
+// there are at least `min` of them, and that they are all numbers.
+func arithmetic(name string, min int, op func(SExpr) (SExpr, error)) builtin {
+	rator := Invariant(name)
+	return builtin{Invariant: rator, pure: true, f: func(randList SExpr) (SExpr, error) {
+		if actual := randLength(randList); actual < min {
+			return nil, &ArityError{Proc: rator, Expected: min, Variadic: true, Actual: actual}
+		}
+		for cur := randList; !IsNull(cur); cur = Cdr(cur) {
+			switch Car(cur).(type) {
+			case Integer, Float:
+			default:
+				return nil, &TypeError{Proc: rator, Expected: "a number", Value: Car(cur)}
+			}
+		}
+		return op(randList)
+	}}
+}
@@ -0,0 +1,483 @@
+/*
+Package lineedit reads lines from a terminal with editing, history, and highlighting of matching parentheses.
+
+If the input is not a terminal, or the terminal cannot be put in raw mode, lines are read without editing.
+*/
+package lineedit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrInterrupt is returned by ReadLine when the user presses Ctrl-C.
+var ErrInterrupt = errors.New("interrupted")
+
+// DefaultMaxHistory is the number of lines kept in the history if MaxHistory is not set.
+const DefaultMaxHistory = 1000
+
+/*
+Editor reads lines from a terminal. The keys are those of readline's emacs mode:
+
+	Left, Ctrl-B / Right, Ctrl-F   move by a character
+	Home, Ctrl-A / End, Ctrl-E     move to the start or end of the line
+	Up, Ctrl-P / Down, Ctrl-N      recall the previous or next line of the history
+	Backspace / Delete             delete the character before or under the cursor
+	Ctrl-K / Ctrl-U / Ctrl-W       delete to the end of the line, to the start of the line, or the previous word
+	Tab                            complete the word before the cursor, or list the candidates
+	Ctrl-L                         clear the screen
+	Ctrl-C                         discard the line and return ErrInterrupt
+	Ctrl-D                         on an empty line, return io.EOF
+
+While the cursor is after a closing parenthesis, the matching opening parenthesis is highlighted.
+*/
+type Editor struct {
+	// The number of lines kept in the history. Older lines are forgotten.
+	MaxHistory int
+	// Complete is called when Tab is pressed. If it is nil, Tab inserts a space.
+	Complete Completer
+
+	in      *os.File
+	reader  *bufio.Reader
+	out     io.Writer
+	width   int // the width of the terminal, in columns
+	history []string
+	file    string // where the history is saved, or "" if it is not saved
+}
+
+// NewEditor returns an editor which reads keys from `in`, which should be a terminal, and writes to `out`.
+func NewEditor(in *os.File, out io.Writer) *Editor {
+	return &Editor{in: in, reader: bufio.NewReader(in), out: out}
+}
+
+// IsTerminal reports whether `f` is a terminal which lines can be edited on.
+func IsTerminal(f *os.File) bool {
+	return isTerminal(f.Fd())
+}
+
+/*
+ReadLine writes `prompt` and returns the line typed by the user, without the newline.
+It returns ErrInterrupt if the user presses Ctrl-C, and io.EOF at the end of the input.
+The line is not added to the history; see AddHistory.
+*/
+func (e *Editor) ReadLine(prompt string) (string, error) {
+	restore, err := makeRaw(e.in.Fd())
+	if err != nil {
+		return e.readPlain(prompt)
+	}
+	defer restore()
+	e.width = termWidth(e.in.Fd())
+	return e.edit(prompt)
+}
+
+// readPlain reads a line without editing
+func (e *Editor) readPlain(prompt string) (string, error) {
+	fmt.Fprint(e.out, prompt)
+	line, err := e.reader.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+/**
+*** History
+**/
+
+// History returns the lines of the history, oldest first.
+func (e *Editor) History() []string {
+	return append([]string{}, e.history...)
+}
+
+func (e *Editor) maxHistory() int {
+	if e.MaxHistory > 0 {
+		return e.MaxHistory
+	}
+	return DefaultMaxHistory
+}
+
+// LoadHistory reads the history from the file `fname`, and saves the lines added by AddHistory to it.
+// A file which does not exist is created when the first line is added.
+// A file with more than MaxHistory lines is rewritten with only the most recent lines.
+func (e *Editor) LoadHistory(fname string) error {
+	e.file = fname
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	e.history = nil
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			e.history = append(e.history, line)
+		}
+	}
+	if extra := len(e.history) - e.maxHistory(); extra > 0 {
+		e.history = e.history[extra:]
+		if err := ioutil.WriteFile(fname, []byte(strings.Join(e.history, "\n")+"\n"), 0600); err != nil {
+			e.file = ""
+			return err
+		}
+	}
+	return nil
+}
+
+// AddHistory adds `line` to the history, unless it is empty or the same as the last line,
+// and appends it to the history file if there is one. A line of several lines is joined into one.
+// If the file cannot be written, the error is returned and the history is no longer saved.
+func (e *Editor) AddHistory(line string) error {
+	lines := strings.Split(line, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	line = strings.TrimSpace(strings.Join(lines, " "))
+	if line == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return nil
+	}
+	e.history = append(e.history, line)
+	if extra := len(e.history) - e.maxHistory(); extra > 0 {
+		e.history = e.history[extra:]
+	}
+	if e.file == "" {
+		return nil
+	}
+	f, err := os.OpenFile(e.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err == nil {
+		_, err = fmt.Fprintln(f, line)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		e.file = ""
+	}
+	return err
+}
+
+/**
+*** Completion
+**/
+
+/*
+Completer returns the candidates for completing the line `head`, which is the line up to the cursor.
+The candidates replace the end of `head` from the byte index `start`.
+
+If there is a single candidate, it is inserted followed by a space, unless it ends with a "/".
+Otherwise the longest prefix common to the candidates is inserted, and if that adds nothing, the candidates are listed.
+*/
+type Completer func(head string) (start int, candidates []string)
+
+func commonPrefix(candidates []string) string {
+	prefix := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, prefix) {
+			_, size := utf8.DecodeLastRuneInString(prefix)
+			prefix = prefix[:len(prefix)-size]
+		}
+	}
+	return prefix
+}
+
+// complete completes the word before the cursor of `l`
+func (e *Editor) complete(l *lineState) {
+	head := string(l.buf[:l.pos])
+	start, candidates := e.Complete(head)
+	if start < 0 || start > len(head) || len(candidates) == 0 {
+		// the terminal bell
+		fmt.Fprint(e.out, "\a")
+		return
+	}
+	word := head[start:]
+	completion := commonPrefix(candidates)
+	if len(candidates) == 1 && !strings.HasSuffix(completion, "/") {
+		completion += " "
+	}
+	if completion != word && strings.HasPrefix(completion, word) {
+		for _, r := range completion[len(word):] {
+			l.insert(r)
+		}
+		return
+	}
+	if len(candidates) > 1 {
+		e.list(candidates)
+	}
+}
+
+// list writes `candidates` in columns below the line. The line is redrawn after them.
+func (e *Editor) list(candidates []string) {
+	width := e.width
+	if width <= 0 {
+		width = 80
+	}
+	colWidth := 0
+	for _, c := range candidates {
+		if n := utf8.RuneCountInString(c) + 2; n > colWidth {
+			colWidth = n
+		}
+	}
+	cols := width / colWidth
+	if cols < 1 {
+		cols = 1
+	}
+	rows := (len(candidates) + cols - 1) / cols
+
+	var b strings.Builder
+	b.WriteString("\r\n")
+	for row := 0; row < rows; row++ {
+		// candidates are sorted down the columns, like ls
+		for col := 0; col < cols; col++ {
+			i := col*rows + row
+			if i >= len(candidates) {
+				break
+			}
+			c := candidates[i]
+			if col < cols-1 && i+rows < len(candidates) {
+				c += strings.Repeat(" ", colWidth-utf8.RuneCountInString(c))
+			}
+			b.WriteString(c)
+		}
+		b.WriteString("\r\n")
+	}
+	io.WriteString(e.out, b.String())
+}
+
+/**
+*** Editing
+**/
+
+func ctrl(key rune) rune {
+	return key & 0x1f
+}
+
+// lineState is the line being edited
+type lineState struct {
+	prompt string
+	buf    []rune
+	pos    int  // the cursor, as an index into buf
+	done   bool // the line has been entered, so parentheses are not highlighted
+}
+
+// edit reads keys until the line is finished. The terminal must be in raw mode.
+func (e *Editor) edit(prompt string) (string, error) {
+	l := &lineState{prompt: prompt}
+	// history[i] is being edited; the line being typed is kept in `typed` while browsing
+	index, typed := len(e.history), ""
+	recall := func(i int) {
+		if i < 0 || i > len(e.history) {
+			return
+		}
+		if index == len(e.history) {
+			typed = string(l.buf)
+		}
+		index = i
+		if i == len(e.history) {
+			l.buf = []rune(typed)
+		} else {
+			l.buf = []rune(e.history[i])
+		}
+		l.pos = len(l.buf)
+	}
+
+	e.refresh(l)
+	for {
+		key, _, err := e.reader.ReadRune()
+		if err != nil {
+			if err == io.EOF && len(l.buf) > 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return string(l.buf), nil
+			}
+			return "", err
+		}
+
+		switch key {
+		case '\r', '\n':
+			l.pos, l.done = len(l.buf), true
+			e.refresh(l)
+			fmt.Fprint(e.out, "\r\n")
+			return string(l.buf), nil
+		case ctrl('C'):
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", ErrInterrupt
+		case ctrl('D'):
+			if len(l.buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			l.delete(l.pos, l.pos+1)
+		case ctrl('A'):
+			l.pos = 0
+		case ctrl('E'):
+			l.pos = len(l.buf)
+		case ctrl('B'):
+			l.move(-1)
+		case ctrl('F'):
+			l.move(1)
+		case ctrl('H'), 127:
+			if l.pos > 0 {
+				l.delete(l.pos-1, l.pos)
+			}
+		case ctrl('K'):
+			l.delete(l.pos, len(l.buf))
+		case ctrl('U'):
+			l.delete(0, l.pos)
+		case ctrl('W'):
+			start := l.pos
+			for start > 0 && unicode.IsSpace(l.buf[start-1]) {
+				start--
+			}
+			for start > 0 && !unicode.IsSpace(l.buf[start-1]) && l.buf[start-1] != '(' {
+				start--
+			}
+			l.delete(start, l.pos)
+		case ctrl('P'):
+			recall(index - 1)
+		case ctrl('N'):
+			recall(index + 1)
+		case ctrl('L'):
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case 27:
+			switch e.escape() {
+			case "[A", "OA":
+				recall(index - 1)
+			case "[B", "OB":
+				recall(index + 1)
+			case "[C", "OC":
+				l.move(1)
+			case "[D", "OD":
+				l.move(-1)
+			case "[H", "OH", "[1~", "[7~":
+				l.pos = 0
+			case "[F", "OF", "[4~", "[8~":
+				l.pos = len(l.buf)
+			case "[3~":
+				l.delete(l.pos, l.pos+1)
+			}
+		case '\t':
+			if e.Complete == nil {
+				l.insert(' ')
+			} else {
+				e.complete(l)
+			}
+		default:
+			if unicode.IsPrint(key) {
+				l.insert(key)
+			}
+		}
+		e.refresh(l)
+	}
+}
+
+// escape reads the rest of an escape sequence, and returns it without the escape character.
+// Sequences are a character followed by parameters and a final letter or ~.
+func (e *Editor) escape() string {
+	var seq []rune
+	for {
+		key, _, err := e.reader.ReadRune()
+		if err != nil {
+			return string(seq)
+		}
+		seq = append(seq, key)
+		if len(seq) > 1 && (unicode.IsLetter(key) || key == '~') {
+			return string(seq)
+		}
+		if len(seq) == 1 && key != '[' && key != 'O' {
+			// Alt and a key, which has no binding
+			return string(seq)
+		}
+	}
+}
+
+func (l *lineState) insert(r rune) {
+	l.buf = append(l.buf, 0)
+	copy(l.buf[l.pos+1:], l.buf[l.pos:])
+	l.buf[l.pos] = r
+	l.pos++
+}
+
+// delete removes the runes from `from` up to `to`, and moves the cursor to `from`
+func (l *lineState) delete(from, to int) {
+	if to > len(l.buf) {
+		to = len(l.buf)
+	}
+	if from >= to {
+		return
+	}
+	l.buf = append(l.buf[:from], l.buf[to:]...)
+	l.pos = from
+}
+
+func (l *lineState) move(by int) {
+	if pos := l.pos + by; pos >= 0 && pos <= len(l.buf) {
+		l.pos = pos
+	}
+}
+
+// matchingParen returns the index of the parenthesis which matches the one before the cursor, or -1 if there is none.
+func matchingParen(buf []rune, pos int) int {
+	if pos == 0 || buf[pos-1] != ')' {
+		return -1
+	}
+	depth := 0
+	for i := pos - 1; i >= 0; i-- {
+		switch buf[i] {
+		case ')':
+			depth++
+		case '(':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// refresh redraws the line. A line wider than the terminal scrolls to keep the cursor visible.
+func (e *Editor) refresh(l *lineState) {
+	width := e.width
+	if width <= 0 {
+		width = 80
+	}
+	promptWidth := utf8.RuneCountInString(l.prompt)
+	avail := width - promptWidth - 1
+	if avail < 1 {
+		avail = 1
+	}
+	start := 0
+	if l.pos > avail {
+		start = l.pos - avail
+	}
+	end := start + avail
+	if end > len(l.buf) {
+		end = len(l.buf)
+	}
+	match := -1
+	if !l.done {
+		match = matchingParen(l.buf, l.pos)
+	}
+
+	var b strings.Builder
+	b.WriteString("\r")
+	b.WriteString(l.prompt)
+	for i := start; i < end; i++ {
+		if i == match {
+			// reverse video
+			fmt.Fprintf(&b, "\x1b[7m%c\x1b[0m", l.buf[i])
+		} else {
+			b.WriteRune(l.buf[i])
+		}
+	}
+	b.WriteString("\x1b[K\r")
+	if col := promptWidth + l.pos - start; col > 0 {
+		fmt.Fprintf(&b, "\x1b[%dC", col)
+	}
+	io.WriteString(e.out, b.String())
+}
@@ -0,0 +1,158 @@
+package lineedit
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testEditor(keys string) (*Editor, *bytes.Buffer) {
+	var out bytes.Buffer
+	return &Editor{reader: bufio.NewReader(strings.NewReader(keys)), out: &out, width: 80}, &out
+}
+
+func TestEditing(t *testing.T) {
+	cases := []struct {
+		keys, expected string
+	}{
+		{"(car x)\r", "(car x)"},
+		{"(car x\x1b[D\x1b[D\x1b[D\x1b[Dd\r", "(cdar x"},
+		{"abc\x01x\x05y\r", "xabcy"},
+		{"abc\x7f\x7fd\n", "ad"},
+		{"abc\x02\x02\x0b\r", "a"},
+		{"abc def\x17\r", "abc "},
+		{"(car (cdr\x17\r", "(car ("},
+		{"abc\x15x\r", "x"},
+		{"ab\x01\x1b[3~\r", "b"},
+		{"ab\x1b[H1\x1b[F2\r", "1ab2"},
+		{"a\tb\r", "a b"},
+	}
+	for _, c := range cases {
+		e, _ := testEditor(c.keys)
+		line, err := e.edit("> ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != c.expected {
+			t.Errorf("Expected %q to give %q but was %q", c.keys, c.expected, line)
+		}
+	}
+}
+
+func TestInterruptAndEOF(t *testing.T) {
+	e, out := testEditor("abc\x03\x04")
+	if _, err := e.edit("> "); err != ErrInterrupt {
+		t.Errorf("Expected ErrInterrupt but was %v", err)
+	}
+	if !strings.Contains(out.String(), "^C") {
+		t.Errorf("Expected ^C to be written but was %q", out.String())
+	}
+	if _, err := e.edit("> "); err != io.EOF {
+		t.Errorf("Expected io.EOF but was %v", err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lineedit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "history")
+
+	e, _ := testEditor("\x1b[A\x1b[A\r\x10\x10\x0e\r")
+	if err := e.LoadHistory(fname); err != nil {
+		t.Fatal(err)
+	}
+	e.AddHistory("(car x)")
+	e.AddHistory("(cdr\n  x)")
+	e.AddHistory("(cdr x)")
+	e.AddHistory("   ")
+	if line, err := e.edit("> "); err != nil || line != "(car x)" {
+		t.Errorf("Expected up twice to recall (car x) but was %q, %v", line, err)
+	}
+	if line, err := e.edit("> "); err != nil || line != "(cdr x)" {
+		t.Errorf("Expected up twice and down to recall (cdr x) but was %q, %v", line, err)
+	}
+
+	loaded := &Editor{MaxHistory: 1}
+	if err := loaded.LoadHistory(fname); err != nil {
+		t.Fatal(err)
+	}
+	if history := loaded.History(); len(history) != 1 || history[0] != "(cdr x)" {
+		t.Errorf("Expected the last line of the history file but was %q", history)
+	}
+	if data, err := ioutil.ReadFile(fname); err != nil || string(data) != "(cdr x)\n" {
+		t.Errorf("Expected the history file to be trimmed to the last line but was %q, %v", data, err)
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	names := []string{"car", "cdr", "cons", "define", "define-memoized"}
+	complete := func(head string) (int, []string) {
+		start := strings.LastIndexAny(head, " (") + 1
+		candidates := []string{}
+		for _, name := range names {
+			if strings.HasPrefix(name, head[start:]) {
+				candidates = append(candidates, name)
+			}
+		}
+		return start, candidates
+	}
+	cases := []struct {
+		keys, expected string
+	}{
+		{"(ca\t\r", "(car "},
+		{"(de\t\r", "(define"},
+		{"(de\t\t-\t\r", "(define-memoized "},
+		{"(x\t\r", "(x"},
+		{"(dex\x02\t\r", "(definex"},
+	}
+	for _, c := range cases {
+		e, _ := testEditor(c.keys)
+		e.Complete = complete
+		line, err := e.edit("> ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != c.expected {
+			t.Errorf("Expected %q to give %q but was %q", c.keys, c.expected, line)
+		}
+	}
+
+	e, out := testEditor("(c\t\r")
+	e.Complete = complete
+	e.width = 14
+	e.edit("> ")
+	if !strings.Contains(out.String(), "\r\ncar   cons\r\ncdr\r\n") {
+		t.Errorf("Expected the candidates to be listed in columns but was %q", out.String())
+	}
+}
+
+func TestParenMatching(t *testing.T) {
+	buf := []rune("(a (b c) d)")
+	if i := matchingParen(buf, len(buf)); i != 0 {
+		t.Errorf("Expected the outer parenthesis to match 0 but was %d", i)
+	}
+	if i := matchingParen(buf, 8); i != 3 {
+		t.Errorf("Expected the inner parenthesis to match 3 but was %d", i)
+	}
+	if i := matchingParen(buf, 2); i != -1 {
+		t.Errorf("Expected no match after a symbol but was %d", i)
+	}
+	if i := matchingParen([]rune("a)"), 2); i != -1 {
+		t.Errorf("Expected no match for an unbalanced parenthesis but was %d", i)
+	}
+
+	_, out := testEditor("")
+	e := &Editor{out: out, width: 80}
+	e.refresh(&lineState{prompt: "> ", buf: buf, pos: len(buf)})
+	if !strings.Contains(out.String(), "\x1b[7m(\x1b[0ma (b c) d)") {
+		t.Errorf("Expected the matching parenthesis to be highlighted but was %q", out.String())
+	}
+}
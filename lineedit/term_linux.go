@@ -0,0 +1,12 @@
+//go:build linux
+// +build linux
+
+package lineedit
+
+import "syscall"
+
+// the ioctl requests which get and set the terminal mode
+const (
+	ioctlGetTermios = syscall.TCGETS
+	ioctlSetTermios = syscall.TCSETS
+)
@@ -0,0 +1,22 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package lineedit
+
+import (
+	"errors"
+)
+
+// Raw mode is only implemented for Linux, macOS and the BSDs. Elsewhere, lines are read without editing.
+
+func isTerminal(fd uintptr) bool {
+	return false
+}
+
+func makeRaw(fd uintptr) (func(), error) {
+	return nil, errors.New("line editing is not supported on this platform")
+}
+
+func termWidth(fd uintptr) int {
+	return 80
+}
@@ -1,37 +1,137 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/zfjagann/gamma/interp"
+	"github.com/zfjagann/gamma/lineedit"
 	"github.com/zfjagann/gamma/parse"
 	"github.com/zfjagann/gamma/sexpr"
 	"io"
 	"os"
+	"runtime"
+	"time"
 )
 
 func main() {
 	fname := flag.String("f", "-", "specify a file to run")
+	workers := flag.Int("j", runtime.NumCPU(), "maximum number of threads used by pmap, pfor-each, pfilter and preduce")
+	sandbox := flag.String("sandbox", "full", "restrict the available primitives to a profile: pure, safe or full")
+	profile := flag.String("profile", "", "write a pprof profile of the program to this file, and a report of its procedures to standard error")
+	cover := flag.Bool("cover", false, "write a summary of the expressions evaluated by the program to standard error")
+	coverHTML := flag.String("coverhtml", "", "write the source of the program annotated with the expressions it evaluated to this HTML file; implies -cover")
 	flag.Parse()
 
-	if *fname == "-" {
-		os.Exit(repl(true, os.Stdin))
+	env, err := interp.ProfileEnvironment(*sandbox)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(255)
+	}
+	opts := []interp.Option{interp.WithWorkers(*workers)}
+
+	if flag.Arg(0) == "debug" {
+		// gamma debug FILE runs FILE in the debugger
+		if flag.NArg() != 2 {
+			fmt.Println("usage: gamma debug FILE")
+			os.Exit(255)
+		}
+		*fname = flag.Arg(1)
+		opts = append(opts, interp.WithDebugger(interp.NewDebugger(os.Stdin, os.Stdout)))
+	}
+
+	if flag.NArg() == 1 && *fname == "-" && flag.Arg(0) != "test" {
+		// gamma FILE is the same as gamma -f FILE
+		*fname = flag.Arg(0)
+	}
+
+	var profiler *interp.Profiler
+	if *profile != "" {
+		profiler = interp.NewProfiler(10 * time.Millisecond)
+		opts = append(opts, interp.WithProfiler(profiler))
+		profiler.Start()
+	}
+
+	var coverage *interp.Coverage
+	if *cover || *coverHTML != "" {
+		coverage = interp.NewCoverage()
+		opts = append(opts, interp.WithCoverage(coverage))
+	}
+
+	var code int
+	if flag.Arg(0) == "test" {
+		// gamma test [-v] [-junit FILE] PATH... runs the test files in PATH...
+		code = runTests(flag.Args()[1:], env, opts)
+	} else if *fname == "-" && lineedit.IsTerminal(os.Stdin) {
+		code = console(env, opts)
+	} else if *fname == "-" {
+		code = repl(true, os.Stdin, "", env, opts)
 	} else {
 		input, err := os.Open(*fname)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(255)
 		}
-		os.Exit(repl(false, input))
+		code = repl(false, input, *fname, env, opts)
+	}
+
+	if profiler != nil {
+		profiler.Stop()
+		if err := writeProfile(profiler, *profile); err != nil {
+			fmt.Println(err)
+			os.Exit(255)
+		}
+	}
+	if coverage != nil {
+		if err := writeCoverage(coverage, *coverHTML); err != nil {
+			fmt.Println(err)
+			os.Exit(255)
+		}
 	}
+	os.Exit(code)
 }
 
-func repl(interactive bool, input io.Reader) int {
-	parser := parse.NewParser(input)
-	eval := interp.NewInterpreter(interp.DefaultEnvironment)
+// writeProfile writes the profile to `fname`, and the report to standard error.
+func writeProfile(profiler *interp.Profiler, fname string) error {
+	out, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	if err := profiler.WriteProfile(out); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return profiler.WriteReport(os.Stderr)
+}
+
+// writeCoverage writes the coverage summary to standard error, and the HTML report to `fname` if it is not empty.
+func writeCoverage(coverage *interp.Coverage, fname string) error {
+	if err := coverage.WriteSummary(os.Stderr); err != nil {
+		return err
+	}
+	if fname == "" {
+		return nil
+	}
+	out, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	if err := coverage.WriteHTML(out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func repl(interactive bool, input io.Reader, file string, env *sexpr.Environ, opts []interp.Option) int {
+	parser := parse.NewFileParser(input, file)
+	eval := interp.NewInterpreter(env, opts...)
 	for {
 		if interactive {
-			fmt.Print("scheme00> ")
+			fmt.Print(prompt)
 		}
 		input, err := parser.Parse()
 		if err != nil {
@@ -47,10 +147,14 @@ func repl(interactive bool, input io.Reader) int {
 		}
 		output, err := eval.Evaluate(input)
 		if err != nil {
-			if err == interp.Exit {
-				return 0
+			var exit *interp.ExitError
+			if errors.As(err, &exit) {
+				return exit.Code
 			}
-			fmt.Println(err)
+			if errors.Is(err, interp.Quit) {
+				return 1
+			}
+			printError(err)
 			if !interactive {
 				return 2
 			}
@@ -60,6 +164,19 @@ func repl(interactive bool, input io.Reader) int {
 	}
 }
 
+// printError prints `err` with its location and backtrace, if they are known.
+func printError(err error) {
+	fmt.Println(err)
+	if c := interp.ContextOf(err); c != nil {
+		if c.Pos != nil {
+			fmt.Printf("  at %v\n", c.Pos)
+		}
+		if len(c.Backtrace) > 0 {
+			fmt.Println(c.Backtrace)
+		}
+	}
+}
+
 func run(fname string) {
 	input, err := os.Open(fname)
 	if err != nil {
@@ -79,7 +196,7 @@ func run(fname string) {
 		}
 		output, err := eval.Evaluate(input)
 		if err != nil {
-			if err == interp.Exit {
+			if errors.Is(err, interp.Exit) {
 				return
 			}
 			fmt.Println(err)
@@ -22,6 +22,20 @@ type Parser struct {
 	reader   *bufio.Reader
 	offset   int
 	lastRead rune
+
+	pos     sexpr.Position // the location of the next rune
+	prevPos sexpr.Position // the location of the last rune read
+}
+
+// Error is a syntax error in the input of the parser.
+type Error struct {
+	Msg    string
+	Offset int            // the offset within the expression being parsed
+	Pos    sexpr.Position // the location in the input
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s at offset %d", e.Msg, e.Offset)
 }
 
 func (p *Parser) errorf(f string, items ...interface{}) error {
@@ -29,23 +43,45 @@ func (p *Parser) errorf(f string, items ...interface{}) error {
 }
 
 func (p *Parser) error(msg string) error {
-	return fmt.Errorf(msg+" at offset %d", p.offset)
+	return &Error{msg, p.offset, p.pos}
 }
 
 func NewParser(reader io.Reader) *Parser {
-	return &Parser{bufio.NewReaderSize(reader, bufferSize), 0, '\000'}
+	return NewFileParser(reader, "")
+}
+
+// NewFileParser returns a parser which reads from `reader`, and reports locations within the file named `file`.
+func NewFileParser(reader io.Reader, file string) *Parser {
+	pos := sexpr.Position{File: file, Line: 1, Column: 1}
+	return &Parser{bufio.NewReaderSize(reader, bufferSize), 0, '\000', pos, pos}
 }
 
 func (p *Parser) readCh() (rune, error) {
 	var err error
 	p.lastRead, _, err = p.reader.ReadRune()
 	p.offset += len(string(p.lastRead))
+	if err == nil {
+		p.prevPos = p.pos
+		if p.lastRead == '\n' {
+			p.pos.Line++
+			p.pos.Column = 1
+		} else {
+			p.pos.Column++
+		}
+	}
 	return p.lastRead, err
 }
 
 func (p *Parser) unread() {
 	p.offset -= len(string(p.lastRead))
-	p.reader.UnreadRune()
+	p.unreadRune()
+}
+
+// unreadRune unreads the last rune without changing the offset
+func (p *Parser) unreadRune() {
+	if p.reader.UnreadRune() == nil {
+		p.pos = p.prevPos
+	}
 }
 
 func (p *Parser) Parse() (sexpr.SExpr, error) {
@@ -78,7 +114,13 @@ func (p *Parser) readSExpr() (sexpr.SExpr, bool, error) {
 		}
 		return sexpr.Quote(literalExpr), eof, nil
 	} else if ch == '(' {
-		return p.readList()
+		start := p.prevPos
+		list, eof, err := p.readList()
+		if pair, ok := list.(*sexpr.Pair); ok {
+			end := p.pos
+			pair.Pos, pair.End = &start, &end
+		}
+		return list, eof, err
 	} else if ch == '#' {
 		return p.readBoolean()
 	} else if unicode.IsDigit(ch) {
@@ -118,6 +160,7 @@ func (p *Parser) readList() (sexpr.SExpr, bool, error) {
 		}
 		return e, eof, nil
 	} else {
+		start := p.prevPos
 		p.unread()
 		head, eof, err := p.readSExpr()
 		if err != nil {
@@ -126,11 +169,12 @@ func (p *Parser) readList() (sexpr.SExpr, bool, error) {
 		if eof {
 			return nil, false, p.error("unexpected EOF in list")
 		}
+		end := p.pos
 		tail, eof, err := p.readList()
 		if err != nil {
 			return nil, false, err
 		}
-		return sexpr.Cons(head, tail), eof, nil
+		return &sexpr.Pair{Car: head, Cdr: tail, Pos: &start, End: &end}, eof, nil
 	}
 }
 
@@ -169,7 +213,7 @@ func (p *Parser) readSymbol() (sexpr.SExpr, bool, error) {
 	} else if name == "" {
 		return nil, false, p.errorf("unexpected '%v'. expecting symbol", string(ch))
 	}
-	p.reader.UnreadRune()
+	p.unreadRune()
 	return sexpr.Symbol(name), err == io.EOF, nil
 }
 func (p *Parser) readNumber() (sexpr.SExpr, bool, error) {
@@ -189,7 +233,7 @@ func (p *Parser) readNumber() (sexpr.SExpr, bool, error) {
 	if numstr == "" && err == io.EOF {
 		return nil, false, p.error("unexpected EOF in number expression")
 	}
-	p.reader.UnreadRune()
+	p.unreadRune()
 	if strings.Contains(numstr, ".") {
 		f, ferr := strconv.ParseFloat(numstr, 64)
 		if ferr != nil {
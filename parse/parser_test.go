@@ -3,6 +3,7 @@ package parse_test
 import (
 	"github.com/zfjagann/gamma/parse"
 	. "github.com/zfjagann/gamma/sexpr"
+	"strings"
 	"testing"
 )
 
@@ -58,3 +59,41 @@ func TestParsesSymbol(t *testing.T) {
 		c.Do(t)
 	}
 }
+
+func TestParsesPositions(t *testing.T) {
+	p := parse.NewFileParser(strings.NewReader("(a\n  (b c))\n(d)\n(e"), "test.scm")
+	expr, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := Cdr(expr).(*Pair)
+	for _, c := range []struct {
+		pos      *Position
+		expected string
+	}{
+		{PosOf(expr), "test.scm:1:1"},
+		{inner.Pos, "test.scm:2:3"},
+		{PosOf(inner.Car), "test.scm:2:3"},
+		{PosOf(Cdr(inner.Car)), "test.scm:2:6"},
+		{expr.(*Pair).End, "test.scm:2:9"},
+		{inner.End, "test.scm:2:8"},
+		{Cdr(inner.Car).(*Pair).End, "test.scm:2:7"},
+	} {
+		if c.pos == nil || c.pos.String() != c.expected {
+			t.Errorf("Expected position %v but was %v", c.expected, c.pos)
+		}
+	}
+
+	expr, err = p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos := PosOf(expr); pos == nil || pos.String() != "test.scm:3:1" {
+		t.Errorf("Expected position test.scm:3:1 but was %v", pos)
+	}
+
+	_, err = p.Parse()
+	if perr, ok := err.(*parse.Error); !ok || perr.Pos.Line != 4 {
+		t.Errorf("Expected a parse error on line 4 but was %#v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package sexpr
+
+import (
+	"fmt"
+)
+
+/**
+*** Channel
+**/
+
+// Channel is a communication channel between parallel threads, backed by a Go channel.
+type Channel struct {
+	C chan SExpr
+}
+
+// NewChannel returns a channel which can hold `size` values before a send blocks.
+func NewChannel(size int) *Channel {
+	return &Channel{make(chan SExpr, size)}
+}
+
+func (c *Channel) IsEq(other Comparable) bool {
+	otherc, ok := other.(*Channel)
+	return ok && c == otherc
+}
+
+func (c *Channel) String() string {
+	return fmt.Sprintf("<channel %d/%d>", len(c.C), cap(c.C))
+}
+
+// Close closes the channel. Returns an error if the channel has already been closed.
+func (c *Channel) Close() (err error) {
+	defer func() {
+		if recover() != nil {
+			err = fmt.Errorf("close of closed channel")
+		}
+	}()
+	close(c.C)
+	return nil
+}
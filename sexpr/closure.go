@@ -4,10 +4,13 @@ type Closure struct {
 	SymList SExpr
 	Body    SExpr
 	Env     *Environ
+
+	// Name is the symbol the closure was defined as, or nil if it is anonymous.
+	Name SExpr
 }
 
 func NewClosure(symList, body SExpr, env *Environ) *Closure {
-	return &Closure{symList, body, env}
+	return &Closure{SymList: symList, Body: body, Env: env}
 }
 
 func (*Closure) String() string {
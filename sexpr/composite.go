@@ -12,13 +12,32 @@ import (
 
 type Pair struct {
 	Car, Cdr SExpr
+
+	// Pos is the location of the pair in source code, if it was read by the parser.
+	// For the first pair of a list it is the location of the opening parenthesis,
+	// and for the rest it is the location of their Car.
+	Pos *Position
+	// End is the location just after the source code of the pair: after the closing parenthesis
+	// for the first pair of a list, and after their Car for the rest.
+	End *Position
 }
 
 func Cons(car, cdr SExpr) SExpr {
-	return &Pair{car, cdr}
+	return &Pair{Car: car, Cdr: cdr}
+}
+
+// PosOf returns the source location of `e`, or nil if it is not known.
+func PosOf(e SExpr) *Position {
+	if p, ok := e.(*Pair); ok {
+		return p.Pos
+	}
+	return nil
 }
 
 func List(exprs ...SExpr) SExpr {
+	if len(exprs) == 0 {
+		return Null
+	}
 	result := &Pair{}
 	p := result
 	for i, expr := range exprs {
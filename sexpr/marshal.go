@@ -0,0 +1,371 @@
+package sexpr
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+/*
+FromGo converts a Go value to an SExpr, in the spirit of encoding/json.
+
+- Values which are already SExprs are returned unchanged, and nil is `<null>`.
+- Integers and floats become Integer and Float, bools become Boolean and strings become Symbol.
+- Slices and arrays become lists.
+- Maps become association lists of `(key . value)` pairs, sorted by key.
+- Structs become association lists of `(field . value)` pairs, in the order the fields are declared.
+- Pointers and interfaces are converted to the value they point to, or `<null>` if they are nil.
+
+The name of a struct field can be changed with a tag such as `gamma:"name"`.
+Fields tagged with `gamma:"-"` are skipped, and fields tagged with `gamma:",omitempty"` are skipped if they are empty.
+Unexported fields are always skipped. Values which contain themselves cannot be converted.
+*/
+func FromGo(v interface{}) (SExpr, error) {
+	if v == nil {
+		return Null, nil
+	}
+	return fromGo(reflect.ValueOf(v), map[visit]bool{})
+}
+
+/*
+ToGo converts `e` into the Go value pointed to by `target`, reversing FromGo.
+
+Integer values can be stored in any number type and Float values in float types.
+Lists can be stored in slices and arrays, and association lists in maps and structs.
+If a key appears more than once, the first entry is used, as with the most recent binding of an environment.
+Fields of the struct which do not appear in the association list are left unchanged.
+`<null>` stores a nil pointer, slice or interface, and an empty map.
+
+Values stored in an `interface{}` have their natural Go type: int64, float64, bool, string or []interface{}.
+Other SExprs, such as closures, are stored unchanged, as they are in a target of type SExpr.
+*/
+func ToGo(e SExpr, target interface{}) error {
+	if e == nil {
+		return fmt.Errorf("ToGo expects a gamma value but was given nil")
+	}
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("ToGo expects a non-nil pointer but was given %T", target)
+	}
+	return toGo(e, v.Elem())
+}
+
+var sexprType = reflect.TypeOf((*SExpr)(nil)).Elem()
+
+// visit identifies a pointer, map or slice which is being converted by fromGo
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+// fromGo converts `v`, failing if it contains one of the values in `visiting`
+func fromGo(v reflect.Value, visiting map[visit]bool) (SExpr, error) {
+	if !v.IsValid() {
+		return Null, nil
+	}
+	if v.Type().Implements(sexprType) {
+		if (v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr) && v.IsNil() {
+			return Null, nil
+		}
+		return v.Interface().(SExpr), nil
+	}
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Map || v.Kind() == reflect.Slice) && !v.IsNil() {
+		key := visit{v.Pointer(), v.Type(), 0}
+		if v.Kind() == reflect.Slice {
+			key.len = v.Len()
+		}
+		if visiting[key] {
+			return nil, fmt.Errorf("cannot convert a cyclic %v to a gamma value", v.Type())
+		}
+		visiting[key] = true
+		defer delete(visiting, key)
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Integer(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("cannot convert %d to a gamma value: it is too large for an Integer", v.Uint())
+		}
+		return Integer(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return Float(v.Float()), nil
+	case reflect.Bool:
+		return Boolean(v.Bool()), nil
+	case reflect.String:
+		return Symbol(v.String()), nil
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return Null, nil
+		}
+		return fromGo(v.Elem(), visiting)
+	case reflect.Slice, reflect.Array:
+		elems := make([]SExpr, v.Len())
+		for i := range elems {
+			elem, err := fromGo(v.Index(i), visiting)
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = elem
+		}
+		return List(elems...), nil
+	case reflect.Map:
+		pairs := make([]SExpr, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			k, err := fromGo(key, visiting)
+			if err != nil {
+				return nil, err
+			}
+			value, err := fromGo(v.MapIndex(key), visiting)
+			if err != nil {
+				return nil, err
+			}
+			pairs = append(pairs, Cons(k, value))
+		}
+		sort.Slice(pairs, func(i, j int) bool {
+			return Car(pairs[i]).String() < Car(pairs[j]).String()
+		})
+		return List(pairs...), nil
+	case reflect.Struct:
+		pairs := []SExpr{}
+		for _, f := range structFields(v.Type()) {
+			field := v.Field(f.index)
+			if f.omitEmpty && isEmptyValue(field) {
+				continue
+			}
+			value, err := fromGo(field, visiting)
+			if err != nil {
+				return nil, err
+			}
+			pairs = append(pairs, Cons(Symbol(f.name), value))
+		}
+		return List(pairs...), nil
+	}
+	return nil, fmt.Errorf("cannot convert %v to a gamma value", v.Type())
+}
+
+func toGo(e SExpr, v reflect.Value) error {
+	if e == nil {
+		return fmt.Errorf("cannot convert nil to %v", v.Type())
+	}
+	isEmptyInterface := v.Kind() == reflect.Interface && v.NumMethod() == 0
+	if reflect.TypeOf(e).AssignableTo(v.Type()) && !isEmptyInterface {
+		v.Set(reflect.ValueOf(e))
+		return nil
+	}
+	if IsNull(e) {
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Interface:
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		case reflect.Map:
+			v.Set(reflect.MakeMap(v.Type()))
+			return nil
+		case reflect.Struct:
+			return nil
+		}
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i, ok := e.(Integer); ok && !v.OverflowInt(int64(i)) {
+			v.SetInt(int64(i))
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if i, ok := e.(Integer); ok && i >= 0 && !v.OverflowUint(uint64(i)) {
+			v.SetUint(uint64(i))
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		switch n := e.(type) {
+		case Float:
+			v.SetFloat(float64(n))
+			return nil
+		case Integer:
+			v.SetFloat(float64(n))
+			return nil
+		}
+	case reflect.Bool:
+		if b, ok := e.(Boolean); ok {
+			v.SetBool(bool(b))
+			return nil
+		}
+	case reflect.String:
+		if s, ok := e.(Symbol); ok {
+			v.SetString(string(s))
+			return nil
+		}
+	case reflect.Ptr:
+		elem := reflect.New(v.Type().Elem())
+		if err := toGo(e, elem.Elem()); err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+	case reflect.Interface:
+		if isEmptyInterface {
+			if value := naturalGo(e); value == nil {
+				v.Set(reflect.Zero(v.Type()))
+			} else {
+				v.Set(reflect.ValueOf(value))
+			}
+			return nil
+		}
+	case reflect.Slice:
+		if elems, ok := listElems(e); ok {
+			slice := reflect.MakeSlice(v.Type(), len(elems), len(elems))
+			for i, elem := range elems {
+				if err := toGo(elem, slice.Index(i)); err != nil {
+					return err
+				}
+			}
+			v.Set(slice)
+			return nil
+		}
+	case reflect.Array:
+		if elems, ok := listElems(e); ok && len(elems) == v.Len() {
+			for i, elem := range elems {
+				if err := toGo(elem, v.Index(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case reflect.Map:
+		if pairs, ok := assocElems(e); ok {
+			m := reflect.MakeMapWithSize(v.Type(), len(pairs))
+			for _, pair := range pairs {
+				key := reflect.New(v.Type().Key()).Elem()
+				if err := toGo(Car(pair), key); err != nil {
+					return err
+				}
+				if m.MapIndex(key).IsValid() {
+					// the key is shadowed by an earlier entry
+					continue
+				}
+				value := reflect.New(v.Type().Elem()).Elem()
+				if err := toGo(Cdr(pair), value); err != nil {
+					return err
+				}
+				m.SetMapIndex(key, value)
+			}
+			v.Set(m)
+			return nil
+		}
+	case reflect.Struct:
+		if pairs, ok := assocElems(e); ok {
+			fields := structFields(v.Type())
+			set := map[int]bool{}
+			for _, pair := range pairs {
+				for _, f := range fields {
+					if IsEq(Car(pair), Symbol(f.name)) && !set[f.index] {
+						set[f.index] = true
+						if err := toGo(Cdr(pair), v.Field(f.index)); err != nil {
+							return fmt.Errorf("field %s: %v", f.name, err)
+						}
+					}
+				}
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot convert %v to %v", e, v.Type())
+}
+
+// naturalGo converts `e` to the Go value it is stored as in an `interface{}`
+func naturalGo(e SExpr) interface{} {
+	switch x := e.(type) {
+	case Integer:
+		return int64(x)
+	case Float:
+		return float64(x)
+	case Boolean:
+		return bool(x)
+	case Symbol:
+		return string(x)
+	case *Pair:
+		if elems, ok := listElems(x); ok {
+			values := make([]interface{}, len(elems))
+			for i, elem := range elems {
+				values[i] = naturalGo(elem)
+			}
+			return values
+		}
+	}
+	if IsNull(e) {
+		return nil
+	}
+	return e
+}
+
+// listElems returns the elements of `e`, or false if it is not a proper list
+func listElems(e SExpr) ([]SExpr, bool) {
+	elems := []SExpr{}
+	for cur := e; !IsNull(cur); cur = Cdr(cur) {
+		if !IsPair(cur) {
+			return nil, false
+		}
+		elems = append(elems, Car(cur))
+	}
+	return elems, true
+}
+
+// assocElems returns the pairs of an association list or environment, or false if `e` is neither
+func assocElems(e SExpr) ([]SExpr, bool) {
+	if env, ok := e.(*Environ); ok {
+		e = env.Value
+	}
+	pairs, ok := listElems(e)
+	if !ok {
+		return nil, false
+	}
+	for _, pair := range pairs {
+		if !IsPair(pair) {
+			return nil, false
+		}
+	}
+	return pairs, true
+}
+
+type structField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+// structFields returns the fields of struct type `t` which are converted by FromGo and ToGo
+func structFields(t reflect.Type) []structField {
+	fields := []structField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := f.Tag.Get("gamma")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			name, opts = tag[:comma], tag[comma+1:]
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, structField{name, i, opts == "omitempty"})
+	}
+	return fields
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return v.IsZero()
+}
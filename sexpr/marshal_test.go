@@ -0,0 +1,168 @@
+package sexpr_test
+
+import (
+	. "github.com/zfjagann/gamma/sexpr"
+
+	"math"
+	"reflect"
+	"testing"
+)
+
+type point struct {
+	X, Y   int
+	Label  string  `gamma:"label"`
+	Weight float64 `gamma:",omitempty"`
+	Secret string  `gamma:"-"`
+	hidden bool
+}
+
+func TestFromGo(t *testing.T) {
+	cases := []struct {
+		value    interface{}
+		expected SExpr
+	}{
+		{nil, Null},
+		{42, Integer(42)},
+		{uint8(7), Integer(7)},
+		{1.5, Float(1.5)},
+		{true, True},
+		{"abc", Symbol("abc")},
+		{Symbol("sym"), Symbol("sym")},
+		{[]int{1, 2, 3}, List(Integer(1), Integer(2), Integer(3))},
+		{[]string{}, Null},
+		{[2]bool{true, false}, List(True, False)},
+		{map[string]int{"b": 2, "a": 1}, List(Cons(Symbol("a"), Integer(1)), Cons(Symbol("b"), Integer(2)))},
+		{
+			point{X: 1, Y: 2, Label: "p", Secret: "s"},
+			List(Cons(Symbol("X"), Integer(1)), Cons(Symbol("Y"), Integer(2)), Cons(Symbol("label"), Symbol("p"))),
+		},
+		{&point{Weight: 0.5}, List(
+			Cons(Symbol("X"), Integer(0)), Cons(Symbol("Y"), Integer(0)),
+			Cons(Symbol("label"), Symbol("")), Cons(Symbol("Weight"), Float(0.5)),
+		)},
+		{(*point)(nil), Null},
+		{[]interface{}{1, "a", nil}, List(Integer(1), Symbol("a"), Null)},
+	}
+	for _, c := range cases {
+		actual, err := FromGo(c.value)
+		if err != nil {
+			t.Errorf("FromGo(%#v) failed: %v", c.value, err)
+		} else if !IsEqStar(actual, c.expected) {
+			t.Errorf("FromGo(%#v) = %v, expected %v", c.value, actual, c.expected)
+		}
+	}
+
+	if _, err := FromGo(make(chan int)); err == nil {
+		t.Errorf("FromGo of a chan should fail")
+	}
+
+	type node struct{ Next *node }
+	cyclic := &node{}
+	cyclic.Next = cyclic
+	if _, err := FromGo(cyclic); err == nil {
+		t.Errorf("FromGo of a cyclic value should fail")
+	}
+	loop := []interface{}{nil}
+	loop[0] = loop
+	if _, err := FromGo(loop); err == nil {
+		t.Errorf("FromGo of a cyclic slice should fail")
+	}
+	if _, err := FromGo(uint64(math.MaxUint64)); err == nil {
+		t.Errorf("FromGo of an integer larger than an Integer should fail")
+	}
+	shared := &point{X: 1}
+	if _, err := FromGo([]*point{shared, shared}); err != nil {
+		t.Errorf("FromGo of a value which appears twice failed: %v", err)
+	}
+}
+
+func TestToGo(t *testing.T) {
+	var i int
+	var u uint16
+	var f float32
+	var b bool
+	var s string
+	var ints []int
+	var arr [2]string
+	var m map[string]int
+	var p point
+	var pp *point
+	var any interface{}
+	var e SExpr
+	closure := NewClosure(Null, Null, NewEnviron())
+
+	cases := []struct {
+		from     SExpr
+		target   interface{}
+		expected interface{}
+	}{
+		{Integer(-3), &i, -3},
+		{Integer(3), &u, uint16(3)},
+		{Integer(2), &f, float32(2)},
+		{Float(2.5), &f, float32(2.5)},
+		{True, &b, true},
+		{Symbol("abc"), &s, "abc"},
+		{List(Integer(1), Integer(2)), &ints, []int{1, 2}},
+		{Null, &ints, []int(nil)},
+		{List(Symbol("a"), Symbol("b")), &arr, [2]string{"a", "b"}},
+		{List(Cons(Symbol("a"), Integer(1))), &m, map[string]int{"a": 1}},
+		{MakeEnviron(Symbol("a"), Integer(1)), &m, map[string]int{"a": 1}},
+		{Null, &m, map[string]int{}},
+		{MakeEnviron(Symbol("a"), Integer(1)).Put(Symbol("a"), Integer(2)), &m, map[string]int{"a": 2}},
+		{List(Cons(Symbol("a"), Integer(1)), Cons(Symbol("a"), Integer(2))), &m, map[string]int{"a": 1}},
+		{
+			List(Cons(Symbol("X"), Integer(1)), Cons(Symbol("label"), Symbol("p")), Cons(Symbol("Secret"), Symbol("s"))),
+			&p, point{X: 1, Label: "p"},
+		},
+		{List(Cons(Symbol("X"), Integer(1)), Cons(Symbol("X"), Integer(2))), &p, point{X: 1, Label: "p"}},
+		{List(Cons(Symbol("Y"), Integer(2))), &pp, &point{Y: 2}},
+		{Null, &pp, (*point)(nil)},
+		{List(Integer(1), Float(1.5), Symbol("a"), True), &any, []interface{}{int64(1), 1.5, "a", true}},
+		{Null, &any, nil},
+		{closure, &any, closure},
+		{closure, &e, closure},
+		{Null, &e, Null},
+	}
+	for _, c := range cases {
+		if err := ToGo(c.from, c.target); err != nil {
+			t.Errorf("ToGo(%v, %T) failed: %v", c.from, c.target, err)
+			continue
+		}
+		actual := reflect.ValueOf(c.target).Elem().Interface()
+		if !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("ToGo(%v, %T) = %#v, expected %#v", c.from, c.target, actual, c.expected)
+		}
+	}
+
+	failures := []struct {
+		from   SExpr
+		target interface{}
+	}{
+		{Symbol("a"), &i},
+		{Integer(-1), &u},
+		{Integer(1 << 20), &u},
+		{Float(1.5), &i},
+		{List(Integer(1)), &arr},
+		{Cons(Integer(1), Integer(2)), &ints},
+		{List(Integer(1)), &m},
+		{List(Cons(Symbol("X"), Symbol("a"))), &p},
+	}
+	for _, c := range failures {
+		if err := ToGo(c.from, c.target); err == nil {
+			t.Errorf("ToGo(%v, %T) should fail", c.from, c.target)
+		}
+	}
+
+	if err := ToGo(Integer(1), i); err == nil {
+		t.Errorf("ToGo to a non-pointer should fail")
+	}
+	if err := ToGo(nil, &i); err == nil {
+		t.Errorf("ToGo of nil should fail")
+	}
+	if err := ToGo(Integer(1), nil); err == nil {
+		t.Errorf("ToGo to nil should fail")
+	}
+	if err := ToGo(List(Integer(1), nil), &ints); err == nil {
+		t.Errorf("ToGo of a list containing nil should fail")
+	}
+}
@@ -203,6 +203,16 @@ func Cadr(e SExpr) SExpr {
 	return Car(Cdr(e))
 }
 
+// Only use if you are absolutely sure that `e` is a pair
+func Cddr(e SExpr) SExpr {
+	return Cdr(Cdr(e))
+}
+
+// Only use if you are absolutely sure that `e` is a pair
+func Caddr(e SExpr) SExpr {
+	return Car(Cdr(Cdr(e)))
+}
+
 // Only use if you are absolutely sure that `e` is a pair
 func Caar(e SExpr) SExpr {
 	return Car(Car(e))
@@ -0,0 +1,19 @@
+package sexpr
+
+import (
+	"fmt"
+)
+
+// Position is a location in source code. Lines and columns start at 1.
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
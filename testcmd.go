@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"github.com/zfjagann/gamma/interp"
+	"github.com/zfjagann/gamma/parse"
+	"github.com/zfjagann/gamma/sexpr"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// testFile is the outcome of running a test file
+type testFile struct {
+	name     string
+	results  []interp.TestResult
+	duration time.Duration
+}
+
+func (f *testFile) failed() int {
+	failed := 0
+	for _, result := range f.results {
+		if !result.Passed {
+			failed++
+		}
+	}
+	return failed
+}
+
+// runTests runs the test files named by `args`, each in a new interpreter, and reports the results.
+// Directories are searched recursively for files ending in _test.scm. Returns 1 if any test failed.
+func runTests(args []string, env *sexpr.Environ, opts []interp.Option) int {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	verbose := flags.Bool("v", false, "print every test, not only the failures")
+	junit := flags.String("junit", "", "write the results to this file in JUnit XML format")
+	seed := flags.Int64("seed", 0, "the seed of the random values of check-property, to reproduce a failure")
+	flags.Parse(args)
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	fnames, err := findTests(paths)
+	if err != nil {
+		fmt.Println(err)
+		return 255
+	}
+
+	var files []*testFile
+	passed, failed := 0, 0
+	for _, fname := range fnames {
+		file := runTestFile(fname, *seed, env, opts)
+		files = append(files, file)
+		for _, result := range file.results {
+			if !result.Passed || *verbose {
+				fmt.Printf("--- %v\n", result)
+			}
+		}
+		status := "ok  "
+		if file.failed() > 0 {
+			status = "FAIL"
+		}
+		fmt.Printf("%s  %s  %d passed, %d failed (%v)\n",
+			status, fname, len(file.results)-file.failed(), file.failed(), file.duration.Round(time.Millisecond))
+		passed += len(file.results) - file.failed()
+		failed += file.failed()
+	}
+	if len(fnames) == 0 {
+		fmt.Println("no test files found")
+	} else {
+		fmt.Printf("%d passed, %d failed\n", passed, failed)
+	}
+
+	if *junit != "" {
+		if err := writeJUnit(files, *junit); err != nil {
+			fmt.Println(err)
+			return 255
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// findTests returns the files named by `paths`, and the test files in the directories named by `paths`
+func findTests(paths []string) ([]string, error) {
+	var fnames []string
+	for _, path := range paths {
+		err := filepath.Walk(path, func(fname string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fname == path && !info.IsDir() {
+				fnames = append(fnames, fname)
+			} else if !info.IsDir() && strings.HasSuffix(fname, "_test.scm") {
+				fnames = append(fnames, fname)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fnames, nil
+}
+
+// runTestFile evaluates the file `fname`. An error which is not caught by a test fails the file,
+// and so does a test-begin without a matching test-end.
+func runTestFile(fname string, seed int64, env *sexpr.Environ, opts []interp.Option) *testFile {
+	file := &testFile{name: fname}
+	start := time.Now()
+	defer func() {
+		file.duration = time.Since(start)
+	}()
+
+	runner := interp.NewTestRunner(nil)
+	runner.SetSeed(seed)
+	eval := interp.NewInterpreter(env, append(opts, interp.WithTestRunner(runner))...)
+	fail := func(err error, pos *sexpr.Position) {
+		file.results = append(runner.Results(), interp.TestResult{Name: fname, Pos: pos, Message: err.Error()})
+	}
+
+	input, err := os.Open(fname)
+	if err != nil {
+		fail(err, nil)
+		return file
+	}
+	defer input.Close()
+	parser := parse.NewFileParser(input, fname)
+	for {
+		expr, err := parser.Parse()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			var pos *sexpr.Position
+			if perr, ok := err.(*parse.Error); ok {
+				pos = &perr.Pos
+			}
+			fail(err, pos)
+			return file
+		}
+		if _, err := eval.Evaluate(expr); err != nil {
+			var pos *sexpr.Position
+			if c := interp.ContextOf(err); c != nil {
+				pos = c.Pos
+			}
+			fail(err, pos)
+			return file
+		}
+	}
+	if groups := runner.Groups(); len(groups) > 0 {
+		fail(fmt.Errorf("missing test-end for %s", strings.Join(groups, ", ")), nil)
+		return file
+	}
+	file.results = runner.Results()
+	return file
+}
+
+/**
+*** JUnit XML
+**/
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	File      string        `xml:"file,attr,omitempty"`
+	Line      int           `xml:"line,attr,omitempty"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// writeJUnit writes the results of `files` to `fname`, with a test suite for each file
+func writeJUnit(files []*testFile, fname string) error {
+	report := junitTestSuites{}
+	for _, file := range files {
+		suite := junitTestSuite{Name: file.name, Tests: len(file.results), Failures: file.failed(), Time: seconds(file.duration)}
+		for _, result := range file.results {
+			c := junitTestCase{ClassName: file.name, Name: result.Name, Time: seconds(result.Duration)}
+			if result.Group != "" {
+				c.ClassName += ":" + result.Group
+			}
+			if result.Pos != nil {
+				c.File, c.Line = result.Pos.File, result.Pos.Line
+			}
+			if !result.Passed {
+				c.Failure = &junitFailure{Message: result.Message, Text: result.String()}
+			}
+			suite.Cases = append(suite.Cases, c)
+		}
+		report.Tests += suite.Tests
+		report.Failures += suite.Failures
+		report.Suites = append(report.Suites, suite)
+	}
+
+	out, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	io.WriteString(out, xml.Header)
+	enc := xml.NewEncoder(out)
+	enc.Indent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		out.Close()
+		return err
+	}
+	io.WriteString(out, "\n")
+	return out.Close()
+}